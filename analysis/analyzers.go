@@ -21,6 +21,9 @@ import (
 	"github.com/timwu/mosaicer/util"
 )
 
+// SimpleAnalyzer is the name of the Simple analysis, recorded in index metadata
+const SimpleAnalyzer = "simple"
+
 // Simple performs a simple analysis of the given image into a 1x1 and aspect-ratio sized image samples
 func Simple(img image.Image, samples int) (*ImageData, error) {
 	data := &ImageData{
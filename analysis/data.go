@@ -18,6 +18,8 @@ import "image"
 
 type ImageData struct {
 	AspectRatio image.Point
-	Samples     []*image.NRGBA
-	LabSamples  map[image.Point][]float64
+	// Aspect ratio of the image before it was cropped for analysis, if known
+	SourceAspectRatio image.Point
+	Samples           []*image.NRGBA
+	LabSamples        map[image.Point][]float64
 }
@@ -20,6 +20,9 @@ func bytesToColor(bytes []uint8) colorful.Color {
 	return colorful.Color{R: float64(bytes[0]) / 255.0, G: float64(bytes[1]) / 255.0, B: float64(bytes[2]) / 255.0}
 }
 
+// LabColorSpace describes the color space RGBAToLab converts to, recorded in index metadata
+const LabColorSpace = "CIELAB D65"
+
 func RGBAToLab(bytes []uint8) []float64 {
 	// shift from the rgba sample to l*a*b floats
 	labColors := make([]float64, (len(bytes)/4)*3)
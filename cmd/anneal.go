@@ -0,0 +1,259 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"image"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/source"
+)
+
+// annealing is whether --annealTime or --annealIterations turn on the annealing pass
+func annealing() bool {
+	return annealTime > 0 || annealIterations > 0
+}
+
+// annealer refines the images assigned to the tiles of a grid by simulated annealing. It
+// minimizes the total distance of the tiles, plus --repeatPenalty for every use of an image after
+// its first and --neighborPenalty for every pair of touching tiles with the same image.
+type annealer struct {
+	searches []*tileSearch
+	selected []index.Candidate
+	// tiles[y][x] is the index of the tile at (x, y)
+	tiles [][]int
+	// Uses of each image by base name, so sub-crops are uses of their image
+	uses map[string]int
+}
+
+func newAnnealer(searches []*tileSearch, selected []index.Candidate, tileCount image.Point) *annealer {
+	a := &annealer{
+		searches: searches,
+		selected: selected,
+		tiles:    make([][]int, tileCount.Y),
+		uses:     make(map[string]int),
+	}
+	for y := range a.tiles {
+		a.tiles[y] = make([]int, tileCount.X)
+	}
+	for i, t := range searches {
+		a.tiles[t.point.Y][t.point.X] = i
+		a.uses[source.BaseName(selected[i].Name)]++
+	}
+	return a
+}
+
+// around calls f with each tile within radius of tile i, not including i
+func (a *annealer) around(i, radius int, f func(j int)) {
+	p := a.searches[i].point
+	for y := p.Y - radius; y <= p.Y+radius; y++ {
+		if y < 0 || y >= len(a.tiles) {
+			continue
+		}
+		for x := p.X - radius; x <= p.X+radius; x++ {
+			if x >= 0 && x < len(a.tiles[y]) && (x != p.X || y != p.Y) {
+				f(a.tiles[y][x])
+			}
+		}
+	}
+}
+
+// sameImage is whether tiles i and j use the same image or crops of it
+func (a *annealer) sameImage(i, j int) bool {
+	return source.BaseName(a.selected[i].Name) == source.BaseName(a.selected[j].Name)
+}
+
+// localCost is the distances of the tiles plus the penalties for their neighbors, counting pairs
+// of the tiles that are next to each other once
+func (a *annealer) localCost(tiles ...int) float64 {
+	cost := 0.0
+	for k, i := range tiles {
+		cost += a.selected[i].Distance
+		a.around(i, 1, func(j int) {
+			for _, other := range tiles[:k] {
+				if other == j {
+					return
+				}
+			}
+			if a.sameImage(i, j) {
+				cost += neighborPenalty / distanceScale
+			}
+		})
+	}
+	return cost
+}
+
+// repeatCost is the penalty for the uses of an image after its first
+func repeatCost(uses int) float64 {
+	if uses <= 1 {
+		return 0
+	}
+	return float64(uses-1) * repeatPenalty / distanceScale
+}
+
+// cost is the objective being minimized
+func (a *annealer) cost() float64 {
+	cost := 0.0
+	for i := range a.selected {
+		cost += a.selected[i].Distance
+		a.around(i, 1, func(j int) {
+			if j > i && a.sameImage(i, j) {
+				cost += neighborPenalty / distanceScale
+			}
+		})
+	}
+	for _, uses := range a.uses {
+		cost += repeatCost(uses)
+	}
+	return cost
+}
+
+// allowed is whether tile i can use its image under --minRepeatDistance, ignoring the tiles in except
+func (a *annealer) allowed(i int, except ...int) bool {
+	ok := true
+	a.around(i, minRepeatDistance, func(j int) {
+		for _, e := range except {
+			if j == e {
+				return
+			}
+		}
+		ok = ok && !a.sameImage(i, j)
+	})
+	return ok
+}
+
+// candidate finds the candidate for tile i with name, or false if it is not one of its matches
+func (a *annealer) candidate(i int, name string) (index.Candidate, bool) {
+	for _, c := range a.searches[i].candidates {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return index.Candidate{}, false
+}
+
+// replace tries giving tile i another of its candidates. Returns the change in cost, and an undo
+// function, or false if the move isn't possible.
+func (a *annealer) replace(i int, r *rand.Rand) (float64, func(), bool) {
+	candidates := a.searches[i].candidates
+	old := a.selected[i]
+	next := candidates[r.Intn(len(candidates))]
+	oldBase, nextBase := source.BaseName(old.Name), source.BaseName(next.Name)
+	if next.Name == old.Name || (oldBase != nextBase && maxUses > 0 && a.uses[nextBase] >= maxUses) {
+		return 0, nil, false
+	}
+	before := a.localCost(i) + repeatCost(a.uses[oldBase]) + repeatCost(a.uses[nextBase])
+	a.selected[i] = next
+	a.uses[oldBase]--
+	a.uses[nextBase]++
+	undo := func() {
+		a.selected[i] = old
+		a.uses[oldBase]++
+		a.uses[nextBase]--
+	}
+	if oldBase != nextBase && !a.allowed(i) {
+		undo()
+		return 0, nil, false
+	}
+	after := a.localCost(i) + repeatCost(a.uses[oldBase]) + repeatCost(a.uses[nextBase])
+	return after - before, undo, true
+}
+
+// swap tries swapping the images of tiles i and j, which each need to be one of the other's
+// candidates. The uses of the images don't change.
+func (a *annealer) swap(i, j int) (float64, func(), bool) {
+	oldI, oldJ := a.selected[i], a.selected[j]
+	nextI, okI := a.candidate(i, oldJ.Name)
+	nextJ, okJ := a.candidate(j, oldI.Name)
+	if i == j || !okI || !okJ || oldI.Name == oldJ.Name {
+		return 0, nil, false
+	}
+	before := a.localCost(i, j)
+	a.selected[i], a.selected[j] = nextI, nextJ
+	undo := func() {
+		a.selected[i], a.selected[j] = oldI, oldJ
+	}
+	if !a.allowed(i, j) || !a.allowed(j, i) {
+		undo()
+		return 0, nil, false
+	}
+	return a.localCost(i, j) - before, undo, true
+}
+
+// anneal refines the selected images for the searched tiles of a grid by simulated annealing,
+// for --annealTime or --annealIterations. Returns the refined candidate for each of the searches.
+func anneal(searches []*tileSearch, selected []index.Candidate, tileCount image.Point) []index.Candidate {
+	a := newAnnealer(searches, append([]index.Candidate(nil), selected...), tileCount)
+	r := tileRand(image.Point{X: -1, Y: -1})
+	startCost := a.cost()
+	startTemperature := annealTemperature / distanceScale
+	// The temperature falls to a hundredth of the start by the end of the budget
+	endTemperature := startTemperature / 100
+
+	startTime := time.Now()
+	progress := 0.0
+	accepted := 0
+	iterations := 0
+	for ; ; iterations++ {
+		// Checking the time is slow, so the schedule is only updated every so often
+		if iterations%1000 == 0 && annealTime > 0 {
+			progress = float64(time.Since(startTime)) / float64(annealTime)
+		}
+		if annealIterations > 0 {
+			progress = math.Max(progress, float64(iterations)/float64(annealIterations))
+		}
+		if progress >= 1 {
+			break
+		}
+		temperature := startTemperature * math.Pow(endTemperature/startTemperature, progress)
+
+		i := r.Intn(len(searches))
+		var delta float64
+		var undo func()
+		var ok bool
+		if r.Intn(2) == 0 {
+			delta, undo, ok = a.replace(i, r)
+		} else {
+			delta, undo, ok = a.swap(i, r.Intn(len(searches)))
+		}
+		if !ok {
+			continue
+		}
+		if delta <= 0 || (temperature > 0 && r.Float64() < math.Exp(-delta/temperature)) {
+			accepted++
+		} else {
+			undo()
+		}
+	}
+
+	endCost := a.cost()
+	// A perfect assignment can't be improved on
+	improvement := 0.0
+	if startCost > 0 {
+		improvement = 100 * (startCost - endCost) / startCost
+	}
+	log.Printf("Annealing made %d of %d moves in %v, improving the objective from %.4f to %.4f (%.1f%%)",
+		accepted, iterations, time.Since(startTime).Round(time.Millisecond), startCost, endCost, improvement)
+	totalDistance := 0.0
+	for _, candidate := range a.selected {
+		totalDistance += candidate.Distance
+	}
+	log.Printf("Average match distance after annealing %.4f", totalDistance/float64(len(a.selected)))
+	return a.selected
+}
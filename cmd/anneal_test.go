@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/source"
+)
+
+func TestAnnealMoveDelta(t *testing.T) {
+	defer func(m, d int, n, p float64) {
+		maxUses, minRepeatDistance, neighborPenalty, repeatPenalty = m, d, n, p
+	}(maxUses, minRepeatDistance, neighborPenalty, repeatPenalty)
+	maxUses, minRepeatDistance, neighborPenalty, repeatPenalty = 3, 0, 5, 1
+
+	r := rand.New(rand.NewSource(1))
+	crop := func(x, y int, name string) string {
+		return source.SubCrop{AspectRatio: image.Point{X: 4, Y: 3}, Scale: 70, X: x, Y: y}.Name(name)
+	}
+	// Sub-crops share the uses and neighbor penalties of their image
+	names := []string{"a.jpg", crop(0, 0, "a.jpg"), crop(100, 100, "a.jpg"), "b.jpg", crop(0, 0, "b.jpg"), "c.jpg", "d.jpg"}
+	tileCount := image.Point{X: 3, Y: 3}
+	var searches []*tileSearch
+	var selected []index.Candidate
+	for y := 0; y < tileCount.Y; y++ {
+		for x := 0; x < tileCount.X; x++ {
+			search := &tileSearch{point: image.Point{X: x, Y: y}}
+			for _, name := range names {
+				search.candidates = append(search.candidates, index.Candidate{Name: name, Distance: r.Float64() / 10})
+			}
+			searches = append(searches, search)
+			selected = append(selected, search.candidates[r.Intn(len(names))])
+		}
+	}
+
+	a := newAnnealer(searches, selected, tileCount)
+	moves := 0
+	for n := 0; n < 10000; n++ {
+		before := a.cost()
+		var delta float64
+		var undo func()
+		var ok bool
+		if r.Intn(2) == 0 {
+			delta, undo, ok = a.replace(r.Intn(len(searches)), r)
+		} else {
+			delta, undo, ok = a.swap(r.Intn(len(searches)), r.Intn(len(searches)))
+		}
+		if !ok {
+			if cost := a.cost(); cost != before {
+				t.Fatalf("Move %d was rejected but changed the cost from %v to %v", n, before, cost)
+			}
+			continue
+		}
+		moves++
+		if after := a.cost(); math.Abs(delta-(after-before)) > 1e-9 {
+			t.Fatalf("Move %d changed the cost by %v, but its delta was %v", n, after-before, delta)
+		}
+		if r.Intn(2) == 0 {
+			undo()
+			if cost := a.cost(); math.Abs(cost-before) > 1e-9 {
+				t.Fatalf("Undoing move %d left the cost at %v, expected %v", n, cost, before)
+			}
+		}
+	}
+	if moves < 1000 {
+		t.Fatalf("Only %d of the moves were possible", moves)
+	}
+}
@@ -15,10 +15,16 @@
 package cmd
 
 import (
+	"fmt"
 	"image"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/disintegration/imaging"
@@ -28,6 +34,18 @@ import (
 	"github.com/timwu/mosaicer/util"
 )
 
+const (
+	gridLayout     = "grid"
+	rowsLayout     = "rows"
+	quadtreeLayout = "quadtree"
+	brickLayout    = "brick"
+	offsetLayout   = "offset"
+	hexLayout      = "hex"
+
+	greedyAssignment  = "greedy"
+	optimalAssignment = "optimal"
+)
+
 var (
 	buildCmd = &cobra.Command{
 		Use:   "build",
@@ -35,33 +53,116 @@ var (
 		RunE:  doBuild,
 	}
 
-	src                    = ""
+	srcs                   = []string{}
+	indexPath              = ""
 	tiles                  = 0
 	tileMultiple           = 20
 	tileAspectRatio        = image.Point{4, 3}
+	tileAspectRatioString  = "4:3"
+	tileLayout             = gridLayout
+	tileAspectRatios       = []string{"1:1", "3:2", "16:9"}
+	maxDepth               = 2
+	splitOn                = varianceSplit
+	splitThreshold         = 10.0
+	maxUses                = 0
+	minRepeatDistance      = 0
+	assignment             = greedyAssignment
+	assignmentCandidates   = 20
+	annealTime             = time.Duration(0)
+	annealIterations       = 0
+	annealTemperature      = 1.0
+	repeatPenalty          = 1.0
+	neighborPenalty        = 5.0
+	seed                   = int64(0)
+	selection              = uniformPolicyName
+	temperature            = 1.0
+	threshold              = 5.0
 	fuzziness              = 0
 	referencePatchMultiple = 1
 	cpuprofile             = ""
 	tileSelectionThreads   = 10
 	tilingThreads          = 16
 	blend                  = 1.0
+	correction             = noCorrection
+	maxCorrection          = 10.0
+	approximation          = 0.0
+	augment                = false
+	preload                = false
+	metricName             = "cie76"
+	lightnessWeight        = 1.0
+	contrastWeight         = 0.0
+	tone                   = colorTone
+	shadowColor            = "#2b1a0e"
+	highlightColor         = "#f5e9d3"
+	chromaWeight           = 1.0
+	manifestPath           = ""
 
 	cropImageAspectRatio = ""
 )
 
 func init() {
-	buildCmd.Flags().StringVar(&src, "source", "", "image source. must already have a built storage")
-	buildCmd.Flags().IntVar(&tiles, "tiles", 100, "number of tiles in each dimension")
+	buildCmd.Flags().StringArrayVar(&srcs, "source", nil, "image source. must already have a built index. Can be repeated to use several sources")
+	buildCmd.Flags().StringVar(&indexPath, "index", "", "Use the index merged from the --source values with mosaicer index merge, instead of the index of each source")
+	buildCmd.Flags().IntVar(&tiles, "tiles", 100, "number of tiles in each dimension, before any are split for --layout quadtree, or about how many tiles across each row for --layout rows")
 	buildCmd.Flags().IntVar(&fuzziness, "fuzziness", 5, "number of top images to consider for random selection")
+	buildCmd.Flags().IntVar(&maxUses, "maxUses", 0, "Maximum number of tiles each image can be used for. Once an image runs out, the next best match is used instead. 0 is unlimited")
+	buildCmd.Flags().IntVar(&minRepeatDistance, "minRepeatDistance", 0, "Don't repeat an image within this many tiles of itself, including diagonally. 0 allows repeats next to each other")
+	buildCmd.Flags().StringVar(&assignment, "assignment", greedyAssignment, fmt.Sprintf("How to assign images to tiles. %s gives each tile one of its --fuzziness best matches in turn, %s minimizes the total distance of all the tiles, using each image at most --maxUses times", greedyAssignment, optimalAssignment))
+	buildCmd.Flags().IntVar(&assignmentCandidates, "candidates", 20, fmt.Sprintf("Number of best matches each tile can be assigned to with --assignment %s or annealing", optimalAssignment))
+	buildCmd.Flags().DurationVar(&annealTime, "annealTime", 0, "Time to spend refining the assignment by simulated annealing, which trades match distance against --repeatPenalty and --neighborPenalty. 0 disables it unless --annealIterations is set")
+	buildCmd.Flags().IntVar(&annealIterations, "annealIterations", 0, "Number of moves to try when refining the assignment by simulated annealing. Unlike --annealTime, the same --seed always gives the same mosaic. 0 disables it unless --annealTime is set")
+	buildCmd.Flags().Float64Var(&annealTemperature, "annealTemperature", 1.0, "Starting temperature for annealing, in ΔE. Moves that make the mosaic worse by about this much are often accepted at first, and the temperature cools to a hundredth of it")
+	buildCmd.Flags().Float64Var(&repeatPenalty, "repeatPenalty", 1.0, "Cost in ΔE that annealing adds for each use of an image after its first")
+	buildCmd.Flags().Float64Var(&neighborPenalty, "neighborPenalty", 5.0, "Cost in ΔE that annealing adds for each pair of touching tiles, including diagonally, with the same image")
+	buildCmd.Flags().Int64Var(&seed, "seed", 0, "Seed for the random choices between the best matches. Builds with the same seed and flags give the same mosaic. Defaults to a random seed, which is logged")
+	buildCmd.Flags().StringVar(&selection, "selection", uniformPolicyName, fmt.Sprintf("How to pick between the --fuzziness best matches. %s picks any of them, %s favors the better matches depending on --temperature, "+
+		"%s picks any within --threshold of the best", uniformPolicyName, softmaxPolicyName, thresholdPolicyName))
+	buildCmd.Flags().Float64Var(&temperature, "temperature", 1.0, fmt.Sprintf("Temperature for --selection %s, in ΔE. Lower values favor the best match more strongly", softmaxPolicyName))
+	buildCmd.Flags().Float64Var(&threshold, "threshold", 5.0, fmt.Sprintf("Largest ΔE from the best match for --selection %s", thresholdPolicyName))
 	buildCmd.Flags().IntVar(&referencePatchMultiple, "referencePatchMultiple", 2, "Multiple of the aspect ratio for sizing a patch of the reference image")
+	buildCmd.Flags().StringVar(&manifestPath, "manifest", "", "Also write a JSON manifest of the mosaic to this `file`, with the image, match distance and rotation of every tile and the flags it was built with")
 	buildCmd.Flags().StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to `file`")
+	buildCmd.Flags().StringVar(&tileAspectRatioString, "tileAspectRatio", "4:3", "Aspect ratio of the tiles. The sources must have an index built with the same --tileAspectRatio")
+	buildCmd.Flags().StringVar(&tileLayout, "layout", gridLayout, fmt.Sprintf("How to lay out the tiles. %s is a grid of --tileAspectRatio tiles, %s packs rows with tiles of each of the --tileAspectRatios, "+
+		"%s is a grid of --tileAspectRatio tiles that are split into smaller tiles where the target has detail. "+
+		"%s offsets every other row by half a tile, %s every other column, and %s uses hexagonal tiles", gridLayout, rowsLayout, quadtreeLayout, brickLayout, offsetLayout, hexLayout))
+	buildCmd.Flags().IntVar(&maxDepth, "maxDepth", 2, fmt.Sprintf("Number of times --layout %s can split a tile into quarters", quadtreeLayout))
+	buildCmd.Flags().StringVar(&splitOn, "splitOn", varianceSplit, fmt.Sprintf("What splits a tile for --layout %s. %s splits tiles where the colors of the target vary by more than --splitThreshold, %s splits tiles whose best match is further than --splitThreshold", quadtreeLayout, varianceSplit, errorSplit))
+	buildCmd.Flags().Float64Var(&splitThreshold, "splitThreshold", 10.0, fmt.Sprintf("Threshold in ΔE for splitting a tile with --layout %s", quadtreeLayout))
+	buildCmd.Flags().StringSliceVar(&tileAspectRatios, "tileAspectRatios", []string{"1:1", "3:2", "16:9"}, fmt.Sprintf("Aspect ratios of the tiles for --layout %s. Each needs an index built with that --tileAspectRatio. The rows are as tall as --tileAspectRatio tiles", rowsLayout))
 	buildCmd.Flags().StringVar(&cropImageAspectRatio, "cropImageAspectRatio", "auto", "Aspect ratio to crop the target image to before tiling.")
 	buildCmd.Flags().Float64Var(&blend, "blend", 1.0, "Opacity of the tile on top of the source image. Must be between (0.0, 1.0]. 1.0 means the tile is opaque and covers up the source image.")
+	buildCmd.Flags().StringVar(&correction, "correction", noCorrection, fmt.Sprintf("Color correction of the tiles toward the target. %s moves the average color of each tile to that of the target under it, "+
+		"%s also matches the spread of its colors", meanCorrection, deviationCorrection))
+	buildCmd.Flags().Float64Var(&maxCorrection, "maxCorrection", 10.0, "Largest change in ΔE that --correction makes to a pixel, so that the tiles stay recognizable")
+	buildCmd.Flags().BoolVar(&augment, "augment", false, "Also match mirrored and upside down versions of the images, which gives a small collection four times the variety")
+	buildCmd.Flags().Float64Var(&approximation, "approximation", 0.0, "Allow the nearest neighbor search to return matches within a factor of (1 + approximation) of the best match. 0 is an exact search.")
+	buildCmd.Flags().BoolVar(&preload, "preload", false, "Load the index into memory up front instead of reading it from disk as needed")
+	buildCmd.Flags().StringVar(&metricName, "metric", "cie76", fmt.Sprintf("Color distance metric used for matching, one of %v", index.MetricNames))
+	buildCmd.Flags().Float64Var(&lightnessWeight, "lightnessWeight", 1.0, "Weight of L* differences for --metric weighted")
+	buildCmd.Flags().Float64Var(&chromaWeight, "chromaWeight", 1.0, "Weight of a* and b* differences for --metric weighted")
+	buildCmd.Flags().Float64Var(&contrastWeight, "contrastWeight", 0.0, "Weight of differences in contrast, the spread of L* across a tile, for --metric luminance")
+	buildCmd.Flags().StringVar(&tone, "tone", colorTone, fmt.Sprintf("How to render the mosaic. %s keeps the colors of the tiles, %s renders it in black and white, and %s in shades between --shadowColor and --highlightColor. "+
+		"Use --metric luminance to match tiles by lightness alone for these", colorTone, grayscaleTone, duotoneTone))
+	buildCmd.Flags().StringVar(&shadowColor, "shadowColor", "#2b1a0e", fmt.Sprintf("Color of the darkest tones for --tone %s, as #rrggbb. Defaults to sepia", duotoneTone))
+	buildCmd.Flags().StringVar(&highlightColor, "highlightColor", "#f5e9d3", fmt.Sprintf("Color of the lightest tones for --tone %s, as #rrggbb. Defaults to sepia", duotoneTone))
 	rootCmd.AddCommand(buildCmd)
 }
 
-func selectImages(imgIndex index.Index, targetImg image.Image) (map[string][]image.Point, image.Point, error) {
+// gridTile is a tile of the grid that an image was chosen for
+type gridTile struct {
+	point image.Point
+	// Transform of the image that matched the tile
+	transform index.Transform
+	distance  float64
+}
+
+func selectImages(imgIndex index.Index, targetImg image.Image) (map[string][]gridTile, image.Point, error) {
 	referencePatchSize := tileAspectRatio.Mul(referencePatchMultiple)
+	// Multiple 0 searches against 1x1 samples, but the patch still needs pixels to resize from
+	if referencePatchMultiple == 0 {
+		referencePatchSize = tileAspectRatio
+	}
 
 	imageAspectRatio := util.AspectRatio(targetImg)
 	log.Printf("target img aspect ratio %v, base resolution of %v. Tile aspect ratio %v", imageAspectRatio, targetImg.Bounds().Size(), tileAspectRatio)
@@ -71,83 +172,74 @@ func selectImages(imgIndex index.Index, targetImg image.Image) (map[string][]ima
 	referenceImg := imaging.Resize(targetImg, tileCount.X*referencePatchSize.X, 0, imaging.NearestNeighbor)
 	log.Printf("reference img aspect ratio %v, size %v", util.AspectRatio(referenceImg), referenceImg.Rect.Size())
 
-	progressBar := pb.StartNew(tileCount.X * tileCount.Y)
-	tileNames := make(map[string][]image.Point)
-
-	type tileSelection struct {
-		selectedImage string
-		point         image.Point
-	}
-	selectionsChan := make(chan tileSelection, 10)
-	done := make(chan bool)
-	go func() {
-		for i := 0; i < tileCount.X*tileCount.Y; i++ {
-			t := <-selectionsChan
-			if tileNames[t.selectedImage] == nil {
-				tileNames[t.selectedImage] = make([]image.Point, 0)
-			}
-			tileNames[t.selectedImage] = append(tileNames[t.selectedImage], t.point)
-
-			progressBar.Increment()
-		}
-		progressBar.Finish()
-		done <- true
-	}()
-
-	log.Printf("selecting images for tiles")
-	limiter := util.NewLimiter(tileSelectionThreads)
+	// Search every tile up front, then assign them one at a time so each can see its neighbors
+	searches := make([]*tileSearch, 0, tileCount.X*tileCount.Y)
 	for i := 0; i < tileCount.Y; i++ {
 		for j := 0; j < tileCount.X; j++ {
-			i, j := i, j
-			limiter.Go(func() {
-				clip := imaging.Crop(referenceImg, image.Rectangle{
+			searches = append(searches, &tileSearch{
+				point: image.Point{X: j, Y: i},
+				clip: imaging.Crop(referenceImg, image.Rectangle{
 					Min: image.Point{X: j * referencePatchSize.X, Y: i * referencePatchSize.Y},
 					Max: image.Point{X: (j + 1) * referencePatchSize.X, Y: (i + 1) * referencePatchSize.Y},
-				})
-				selected, err := imgIndex.Search(clip, tileAspectRatio)
-				if err != nil {
-					log.Fatalf("i=%d,j=%d err=%v", i, j, err)
-				}
-				selectionsChan <- tileSelection{
-					selectedImage: selected,
-					point:         image.Point{X: j, Y: i},
-				}
+				}),
+				k: initialK(),
 			})
 		}
 	}
-	limiter.Close()
-	<-done
+	searchTiles(imgIndex, searches, tileAspectRatio)
+
+	log.Printf("selecting images for tiles")
+	selected, err := assignTiles(imgIndex, searches, tileAspectRatio, newUsageLimiter(maxUses), newRepeatGrid(tileCount, minRepeatDistance))
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	if annealing() {
+		selected = anneal(searches, selected, tileCount)
+	}
+	tileNames := make(map[string][]gridTile)
+	for i, t := range searches {
+		tileNames[selected[i].Name] = append(tileNames[selected[i].Name], gridTile{point: t.point, transform: selected[i].Transform, distance: selected[i].Distance})
+	}
 	return tileNames, tileCount, nil
 }
 
-func createOutputImage(targetImg image.Image, imageSource source.ImageSource, tileNames map[string][]image.Point, tileCount image.Point) (*image.NRGBA, error) {
+func createOutputImage(targetImg image.Image, imageSource source.ImageSource, tileNames map[string][]gridTile, tileCount image.Point) (*image.NRGBA, error) {
 	log.Printf("Building output image")
 	tileSize := tileAspectRatio.Mul(tileMultiple)
 	dstImgSize := image.Point{X: tileSize.X * tileCount.X, Y: tileSize.Y * tileCount.Y}
 	log.Printf("dst img size %v", dstImgSize)
 	// dstImg := imaging.New(dstImgSize.X, dstImgSize.Y, color.NRGBA{0, 0, 0, 0})
 	dstImg := imaging.Resize(targetImg, dstImgSize.X, dstImgSize.Y, imaging.Lanczos)
+	// Tiles are corrected toward the target before any are drawn over it
+	referenceImg := dstImg
+	if correction != noCorrection {
+		referenceImg = imaging.Clone(dstImg)
+	}
 	progressBar := pb.StartNew(tileCount.X * tileCount.Y)
-	rotatedTiles := 0
+	var transformedTiles int64
 	limiter := util.NewLimiter(tilingThreads)
-	for selectedName, points := range tileNames {
-		selectedName, points := selectedName, points
+	for selectedName, gridTiles := range tileNames {
+		selectedName, gridTiles := selectedName, gridTiles
 		limiter.Go(func() {
 			selectedImg, err := imageSource.GetImage(selectedName)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			// If the image is rotated relative to the target image's aspect ratio, rotate it first
-			if ar := util.AspectRatio(selectedImg); ar.X == tileAspectRatio.Y && ar.Y == tileAspectRatio.X {
-				selectedImg = imaging.Rotate270(selectedImg)
-				rotatedTiles++
-			}
-
-			resizedTile := imaging.Resize(selectedImg, tileSize.X, 0, imaging.NearestNeighbor)
-
-			for _, point := range points {
-				if err := util.Paste(dstImg, resizedTile, image.Point{X: point.X * tileSize.X, Y: point.Y * tileSize.Y}, blend); err != nil {
+			// Apply the transform that matched each tile, resizing each transformed image once
+			resizedTiles := make(map[index.Transform]*image.NRGBA)
+			for _, t := range gridTiles {
+				resizedTile := resizedTiles[t.transform]
+				if resizedTile == nil {
+					resizedTile = imaging.Resize(t.transform.Apply(selectedImg), tileSize.X, 0, imaging.NearestNeighbor)
+					resizedTiles[t.transform] = resizedTile
+				}
+				if t.transform != index.Identity {
+					atomic.AddInt64(&transformedTiles, 1)
+				}
+				loc := image.Point{X: t.point.X * tileSize.X, Y: t.point.Y * tileSize.Y}
+				tile := correctTile(resizedTile, referenceImg, image.Rectangle{Min: loc, Max: loc.Add(resizedTile.Rect.Size())}, nil)
+				if err := util.Paste(dstImg, tile, loc, blend); err != nil {
 					log.Fatal(err)
 				}
 				progressBar.Increment()
@@ -156,10 +248,125 @@ func createOutputImage(targetImg image.Image, imageSource source.ImageSource, ti
 	}
 	limiter.Close()
 	progressBar.Finish()
-	log.Printf("Used %d rotated tiles", rotatedTiles)
+	log.Printf("Used %d rotated or mirrored tiles", transformedTiles)
 	return dstImg, nil
 }
 
+// openImageSource opens the --source values, namespacing the names if there are several of them
+// or they are searched through a merged --index. The images are cropped to the tile aspect ratio
+// if crop is set.
+func openImageSource(crop bool) (source.ImageSource, error) {
+	if len(srcs) == 0 {
+		return nil, fmt.Errorf("at least one --source is required")
+	}
+	imageSources := make([]source.ImageSource, len(srcs))
+	for i, src := range srcs {
+		imageSource, err := source.NewImageSource(src)
+		if err != nil {
+			return nil, err
+		}
+		imageSources[i] = imageSource
+		if crop {
+			imageSources[i] = source.NewCropSource(imageSource, tileAspectRatio)
+		}
+	}
+	if len(srcs) == 1 && indexPath == "" {
+		return imageSources[0], nil
+	}
+	return source.NewCompositeSource(sourceNamespaces(), imageSources)
+}
+
+// sourceNamespaces are the namespaces of the --source values in a composite source or merged index.
+// They are cleaned so that photos/ and photos are the same source.
+func sourceNamespaces() []string {
+	namespaces := make([]string, len(srcs))
+	for i, src := range srcs {
+		namespaces[i] = filepath.Clean(src)
+	}
+	return namespaces
+}
+
+// checkNamespaces checks that the merged index name was merged from the --source values, so that
+// every image it finds can be loaded
+func checkNamespaces(name string) error {
+	merged, err := index.Namespaces(name)
+	if err != nil {
+		return err
+	}
+	namespaces := sourceNamespaces()
+	sort.Strings(namespaces)
+	if strings.Join(merged, "\n") != strings.Join(namespaces, "\n") {
+		return fmt.Errorf("--index %s was merged from %v, build with the same --source values instead of %v", indexPath, merged, srcs)
+	}
+	return nil
+}
+
+// openIndex opens the index for each of the --source values, or the merged --index, with images
+// cropped to aspectRatio. Their metadata is checked against the build flags first. If
+// sourceAspectRatio is set, only images with a matching aspect ratio before cropping are searched.
+func openIndex(cmd *cobra.Command, aspectRatio image.Point, sourceAspectRatio func(image.Point) bool) (index.Index, error) {
+	indexSources := srcs
+	if indexPath != "" {
+		indexSources = []string{indexPath}
+	}
+	// Each source has a separate index per crop aspect ratio
+	indexNames := make([]string, len(indexSources))
+	for i, indexSource := range indexSources {
+		indexNames[i] = index.Name(indexSource, aspectRatio)
+		metadata, err := index.ReadMetadata(indexNames[i])
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			return nil, fmt.Errorf("no index found for %s with %d:%d tiles. Run mosaicer index --tileAspectRatio %d:%d %s first",
+				indexSource, aspectRatio.X, aspectRatio.Y, aspectRatio.X, aspectRatio.Y, indexSource)
+		}
+		if !cmd.Flags().Changed("referencePatchMultiple") && referencePatchMultiple >= metadata.Samples {
+			log.Printf("index for %s was built with --samples %d, using --referencePatchMultiple %d", indexSource, metadata.Samples, metadata.Samples-1)
+			referencePatchMultiple = metadata.Samples - 1
+		}
+		if util.LandscapeAspectRatio(metadata.CropAspectRatio) != util.LandscapeAspectRatio(aspectRatio) {
+			return nil, fmt.Errorf("index for %s was built with images cropped to %d:%d, which does not match the %d:%d tiles", indexSource,
+				metadata.CropAspectRatio.X, metadata.CropAspectRatio.Y, aspectRatio.X, aspectRatio.Y)
+		}
+		if indexPath != "" {
+			if err := checkNamespaces(indexNames[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	metric, err := index.ParseMetric(metricName, lightnessWeight, chromaWeight, contrastWeight)
+	if err != nil {
+		return nil, err
+	}
+	options := index.Options{
+		Multiple:      referencePatchMultiple,
+		Fuzziness:     fuzziness,
+		Seed:          seed,
+		Approximation: approximation,
+		Augment:       augment,
+		Metric:        metric,
+
+		SourceAspectRatio: sourceAspectRatio,
+	}
+	indexes := make([]index.Index, len(indexSources))
+	for i, name := range indexNames {
+		if preload {
+			indexes[i], err = index.NewInMemoryIndex(name, options)
+		} else {
+			indexes[i], err = index.NewBoltIndex(name, options)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(indexes) == 1 {
+		return indexes[0], nil
+	}
+	return index.NewMultiIndex(sourceNamespaces(), indexes, options)
+}
+
 func doBuild(cmd *cobra.Command, args []string) error {
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
@@ -173,21 +380,31 @@ func doBuild(cmd *cobra.Command, args []string) error {
 		defer pprof.StopCPUProfile()
 	}
 
-	imageSource, err := source.NewImageSource(src)
-	if err != nil {
+	var err error
+	if tileAspectRatio, err = parseTileAspectRatio(tileAspectRatioString); err != nil {
 		return err
 	}
-	imageSource = source.NewCropSource(imageSource, image.Point{X: 4, Y: 3})
-	defer imageSource.Close()
-	imgIndex, err := index.NewBoltIndex(src, referencePatchMultiple, fuzziness)
+	layouts := []string{gridLayout, rowsLayout, quadtreeLayout, brickLayout, offsetLayout, hexLayout}
+	knownLayout := false
+	for _, l := range layouts {
+		knownLayout = knownLayout || tileLayout == l
+	}
+	if !knownLayout {
+		return fmt.Errorf("unknown layout %s, must be one of %v", tileLayout, layouts)
+	}
+	// Rows fit each tile to its cell when drawing it instead
+	imageSource, err := openImageSource(tileLayout != rowsLayout)
 	if err != nil {
 		return err
 	}
+	defer imageSource.Close()
 	targetImg, err := imaging.Open(args[0])
 	if err != nil {
 		return err
 	}
 
+	// The target is cropped around its center
+	targetCrop := targetImg.Bounds()
 	if cropImageAspectRatio == "auto" {
 		targetImg = source.CropImageToAspectRatio(targetImg, util.NearestSaneAspectRatio(util.AspectRatio(targetImg)))
 	} else if cropImageAspectRatio != "none" {
@@ -197,17 +414,93 @@ func doBuild(cmd *cobra.Command, args []string) error {
 		}
 		targetImg = source.CropImageToAspectRatio(targetImg, croppedAspectRatio)
 	}
+	croppedSize := targetImg.Bounds().Size()
+	targetCrop.Min = targetCrop.Min.Add(targetCrop.Size().Sub(croppedSize).Div(2))
+	targetCrop.Max = targetCrop.Min.Add(croppedSize)
 
-	tileNames, tileCount, err := selectImages(imgIndex, targetImg)
+	if !cmd.Flags().Changed("seed") {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("Using --seed %d", seed)
+	if policy, err = newSelectionPolicy(); err != nil {
+		return err
+	}
+	if err := checkCorrection(); err != nil {
+		return err
+	}
+	toneMap, err := newToneMap()
 	if err != nil {
 		return err
 	}
+	if assignment != greedyAssignment && assignment != optimalAssignment {
+		return fmt.Errorf("unknown assignment %s, must be one of %s or %s", assignment, greedyAssignment, optimalAssignment)
+	}
+	// The other layouts always assign tiles greedily, without looking at their neighbors
+	if tileLayout != gridLayout && (minRepeatDistance > 0 || assignment != greedyAssignment) {
+		return fmt.Errorf("--minRepeatDistance and --assignment %s are only supported with --layout %s", optimalAssignment, gridLayout)
+	}
+	if tileLayout == quadtreeLayout && splitOn != varianceSplit && splitOn != errorSplit {
+		return fmt.Errorf("unknown --splitOn %s, must be one of %s or %s", splitOn, varianceSplit, errorSplit)
+	}
+	if assignment == optimalAssignment && minRepeatDistance > 0 {
+		return fmt.Errorf("--minRepeatDistance is not supported with --assignment %s", optimalAssignment)
+	}
+	if assignment == optimalAssignment && assignmentCandidates < 1 {
+		return fmt.Errorf("--candidates must be at least 1")
+	}
+	if annealTime < 0 || annealIterations < 0 {
+		return fmt.Errorf("--annealTime and --annealIterations must not be negative")
+	}
+	if annealing() && tileLayout != gridLayout {
+		return fmt.Errorf("annealing is only supported with --layout %s", gridLayout)
+	}
+	if annealing() && (annealTemperature < 0 || repeatPenalty < 0 || neighborPenalty < 0) {
+		return fmt.Errorf("--annealTemperature, --repeatPenalty and --neighborPenalty must not be negative")
+	}
 
-	log.Printf("Used %d unique images.", len(tileNames))
-	dstImg, err := createOutputImage(targetImg, imageSource, tileNames, tileCount)
+	var dstImg *image.NRGBA
+	var m *manifest
+	switch tileLayout {
+	case rowsLayout:
+		dstImg, m, err = buildRows(cmd, imageSource, targetImg)
+	case quadtreeLayout:
+		dstImg, m, err = buildQuadtree(cmd, imageSource, targetImg)
+	case brickLayout, offsetLayout, hexLayout:
+		dstImg, m, err = buildLattice(cmd, imageSource, targetImg)
+	default:
+		dstImg, m, err = buildGrid(cmd, imageSource, targetImg)
+	}
 	if err != nil {
 		return err
 	}
+	if manifestPath != "" {
+		if err := writeManifest(cmd, m, manifestPath, args[0], targetCrop, dstImg.Rect.Size()); err != nil {
+			return err
+		}
+		log.Printf("Wrote the manifest to %s", manifestPath)
+	}
+	if toneMap != nil {
+		dstImg = toneMap(dstImg)
+	}
 	imaging.Save(dstImg, args[0]+".mosaic.jpg")
 	return nil
 }
+
+// buildGrid tiles the target image with a grid of --tileAspectRatio tiles
+func buildGrid(cmd *cobra.Command, imageSource source.ImageSource, targetImg image.Image) (*image.NRGBA, *manifest, error) {
+	imgIndex, err := openIndex(cmd, tileAspectRatio, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	tileNames, tileCount, err := selectImages(imgIndex, targetImg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Used %d unique images.", len(tileNames))
+	dstImg, err := createOutputImage(targetImg, imageSource, tileNames, tileCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dstImg, gridManifest(tileNames, tileCount, tileAspectRatio.Mul(tileMultiple)), nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"image"
+	"image/draw"
+	"log"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/layout"
+	"github.com/timwu/mosaicer/source"
+	"github.com/timwu/mosaicer/util"
+)
+
+// cellPatch is the part of referenceImg under rect, transparent where it is outside of
+// referenceImg or mask. Transparent pixels are ignored when matching the patch.
+func cellPatch(referenceImg *image.NRGBA, rect image.Rectangle, mask *image.Alpha) *image.NRGBA {
+	patch := image.NewNRGBA(image.Rectangle{Max: rect.Size()})
+	if mask == nil {
+		draw.Draw(patch, patch.Rect, referenceImg, rect.Min, draw.Src)
+	} else {
+		draw.DrawMask(patch, patch.Rect, referenceImg, rect.Min, mask, image.Point{}, draw.Src)
+	}
+	return patch
+}
+
+// selectLattice lays out the target image with the --layout lattice of --tileAspectRatio cells and
+// picks an image for each of them, matching only the visible part of each cell
+func selectLattice(imgIndex index.Index, targetImg image.Image) (layout.Lattice, []placement, error) {
+	tileCount := util.ConvertTiles(util.AspectRatio(targetImg), tileAspectRatio, tiles)
+	lattice, err := layout.NewLattice(tileLayout, tileAspectRatio, tileCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	cells := lattice.Cells()
+	log.Printf("%d %s cells", len(cells), tileLayout)
+
+	// Give the reference image enough pixels per unit for a reference patch sized cell
+	cellSize := cells[0].Rect.Size()
+	patchHeight := tileAspectRatio.Y * referencePatchMultiple
+	if referencePatchMultiple < 1 {
+		patchHeight = tileAspectRatio.Y
+	}
+	pixelsPerUnit := (patchHeight + cellSize.Y - 1) / cellSize.Y
+	size := lattice.Size().Mul(pixelsPerUnit)
+	referenceImg := imaging.Resize(targetImg, size.X, size.Y, imaging.NearestNeighbor)
+	mask := lattice.Mask(cellSize.Mul(pixelsPerUnit))
+
+	placements := make([]placement, len(cells))
+	searches := make([]*tileSearch, len(cells))
+	for i, cell := range cells {
+		placements[i] = placement{cell: cell}
+		// Cells don't overlap, so their corners identify them for --seed
+		searches[i] = &tileSearch{
+			point: cell.Rect.Min,
+			clip:  cellPatch(referenceImg, layout.Scale(cell.Rect, float64(pixelsPerUnit)), mask),
+			k:     initialK(),
+		}
+	}
+	searchTiles(imgIndex, searches, tileAspectRatio)
+
+	log.Printf("selecting images for tiles")
+	selected, err := assignTiles(imgIndex, searches, tileAspectRatio, newUsageLimiter(maxUses), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range placements {
+		placements[i].name = selected[i].Name
+		placements[i].transform = selected[i].Transform
+		placements[i].distance = selected[i].Distance
+	}
+	return lattice, placements, nil
+}
+
+// buildLattice tiles the target image with the --layout lattice of --tileAspectRatio cells
+func buildLattice(cmd *cobra.Command, imageSource source.ImageSource, targetImg image.Image) (*image.NRGBA, *manifest, error) {
+	imgIndex, err := openIndex(cmd, tileAspectRatio, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	lattice, placements, err := selectLattice(imgIndex, targetImg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Cells are the size of grid tiles
+	pixelsPerUnit := float64(tileMultiple*tileAspectRatio.Y) / float64(placements[0].cell.Rect.Dy())
+	dstImg, err := createLayoutOutputImage(targetImg, imageSource, lattice.Size(), pixelsPerUnit, lattice.Mask, placements)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dstImg, layoutManifest(placements, pixelsPerUnit), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"image"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/disintegration/imaging"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/layout"
+	"github.com/timwu/mosaicer/source"
+	"github.com/timwu/mosaicer/util"
+)
+
+// placement is the image chosen for a cell of a layout
+type placement struct {
+	cell layout.Cell
+	name string
+	// Transform of the image that matched the cell
+	transform index.Transform
+	distance  float64
+}
+
+// createLayoutOutputImage draws each placement into its cell of a layout of size units, cropping
+// the image to fit. mask, if not nil, gives the shape of a cell of a size in pixels.
+func createLayoutOutputImage(targetImg image.Image, imageSource source.ImageSource, size image.Point, pixelsPerUnit float64, mask func(size image.Point) *image.Alpha, placements []placement) (*image.NRGBA, error) {
+	log.Printf("Building output image")
+	dstImgSize := layout.Scale(image.Rectangle{Max: size}, pixelsPerUnit).Size()
+	log.Printf("dst img size %v", dstImgSize)
+	dstImg := imaging.Resize(targetImg, dstImgSize.X, dstImgSize.Y, imaging.Lanczos)
+	// Tiles are corrected toward the target before any are drawn over it
+	referenceImg := dstImg
+	if correction != noCorrection {
+		referenceImg = imaging.Clone(dstImg)
+	}
+
+	byName := make(map[string][]placement)
+	for _, p := range placements {
+		byName[p.name] = append(byName[p.name], p)
+	}
+	log.Printf("Used %d unique images.", len(byName))
+
+	progressBar := pb.StartNew(len(placements))
+	var transformedTiles int64
+	var mu sync.Mutex
+	var keptPixels float64
+	limiter := util.NewLimiter(tilingThreads)
+	for name, namePlacements := range byName {
+		name, namePlacements := name, namePlacements
+		limiter.Go(func() {
+			img, err := imageSource.GetImage(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, p := range namePlacements {
+				tileImg := img
+				if p.transform != index.Identity {
+					tileImg = p.transform.Apply(img)
+					atomic.AddInt64(&transformedTiles, 1)
+				}
+				rect := layout.Scale(p.cell.Rect, pixelsPerUnit)
+				// Fraction of the image that is left after cropping it to the cell
+				imgSize := tileImg.Bounds().Size()
+				kept := float64(imgSize.Y*rect.Dx()) / float64(imgSize.X*rect.Dy())
+				if kept > 1 {
+					kept = 1 / kept
+				}
+				mu.Lock()
+				keptPixels += kept
+				mu.Unlock()
+
+				var tileMask *image.Alpha
+				if mask != nil {
+					tileMask = mask(rect.Size())
+				}
+				tile := correctTile(imaging.Fill(tileImg, rect.Dx(), rect.Dy(), imaging.Center, imaging.NearestNeighbor), referenceImg, rect, tileMask)
+				if tileMask == nil && rect.In(dstImg.Rect) {
+					err = util.Paste(dstImg, tile, rect.Min, blend)
+				} else {
+					// Cells can be shaped, or cut off at the edges of the layout
+					err = util.PasteMasked(dstImg, tile, tileMask, rect.Min, blend)
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
+				progressBar.Increment()
+			}
+		})
+	}
+	limiter.Close()
+	progressBar.Finish()
+	log.Printf("Used %d rotated or mirrored tiles", transformedTiles)
+	log.Printf("Cropped away %.1f%% of the pixels of the tile images", 100*(1-keptPixels/float64(len(placements))))
+	return dstImg, nil
+}
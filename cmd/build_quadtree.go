@@ -0,0 +1,155 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"image"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/layout"
+	"github.com/timwu/mosaicer/source"
+	"github.com/timwu/mosaicer/util"
+)
+
+const (
+	varianceSplit = "variance"
+	errorSplit    = "error"
+)
+
+// labDeviation is the root mean square ΔE of the pixels of img from their average color
+func labDeviation(img *image.NRGBA) float64 {
+	lab := analysis.RGBAToLab(img.Pix)
+	pixels := len(lab) / 3
+	if pixels == 0 {
+		return 0
+	}
+	var mean [3]float64
+	for i, v := range lab {
+		mean[i%3] += v / float64(pixels)
+	}
+	total := 0.0
+	for i, v := range lab {
+		total += (v - mean[i%3]) * (v - mean[i%3])
+	}
+	return math.Sqrt(total/float64(pixels)) * distanceScale
+}
+
+// selectQuadtree lays out the target image as a grid of --tiles tiles, splitting the tiles that
+// need more detail according to --splitOn, and picks an image for each of them
+func selectQuadtree(imgIndex index.Index, targetImg image.Image) (*layout.Quadtree, []placement, error) {
+	tileCount := util.ConvertTiles(util.AspectRatio(targetImg), tileAspectRatio, tiles)
+	quadtree, err := layout.NewQuadtree(tileAspectRatio, tileCount, maxDepth)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("tile count %v, split up to %d times", tileCount, maxDepth)
+
+	// The smallest tiles are reference patch sized
+	pixelsPerUnit := referencePatchMultiple
+	if pixelsPerUnit < 1 {
+		pixelsPerUnit = 1
+	}
+	size := quadtree.Size().Mul(pixelsPerUnit)
+	referenceImg := imaging.Resize(targetImg, size.X, size.Y, imaging.NearestNeighbor)
+	clip := func(cell layout.Cell) *image.NRGBA {
+		return imaging.Crop(referenceImg, layout.Scale(cell.Rect, float64(pixelsPerUnit)))
+	}
+	split := func(cell layout.Cell) (bool, error) {
+		if splitOn == varianceSplit {
+			return labDeviation(clip(cell)) > splitThreshold, nil
+		}
+		candidates, err := imgIndex.SearchTopK(clip(cell), tileAspectRatio, 1)
+		if err != nil || len(candidates) == 0 {
+			return false, err
+		}
+		return candidates[0].Distance*distanceScale > splitThreshold, nil
+	}
+
+	log.Printf("splitting tiles")
+	progressBar := pb.StartNew(tileCount.X * tileCount.Y)
+	gridCells := make([][]layout.Cell, tileCount.X*tileCount.Y)
+	var mu sync.Mutex
+	var splitErr error
+	limiter := util.NewLimiter(tileSelectionThreads)
+	for i := range gridCells {
+		i := i
+		limiter.Go(func() {
+			defer progressBar.Increment()
+			cells, err := quadtree.Split(quadtree.Cell(image.Point{X: i % tileCount.X, Y: i / tileCount.X}), split)
+			if err != nil {
+				mu.Lock()
+				splitErr = err
+				mu.Unlock()
+				return
+			}
+			gridCells[i] = cells
+		})
+	}
+	limiter.Close()
+	progressBar.Finish()
+	if splitErr != nil {
+		return nil, nil, splitErr
+	}
+
+	placements := make([]placement, 0, len(gridCells))
+	searches := make([]*tileSearch, 0, len(gridCells))
+	for _, cells := range gridCells {
+		for _, cell := range cells {
+			placements = append(placements, placement{cell: cell})
+			// Cells don't overlap, so their corners identify them for --seed
+			searches = append(searches, &tileSearch{point: cell.Rect.Min, clip: clip(cell), k: initialK()})
+		}
+	}
+	log.Printf("split into %d tiles", len(placements))
+	searchTiles(imgIndex, searches, tileAspectRatio)
+
+	log.Printf("selecting images for tiles")
+	selected, err := assignTiles(imgIndex, searches, tileAspectRatio, newUsageLimiter(maxUses), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range placements {
+		placements[i].name = selected[i].Name
+		placements[i].transform = selected[i].Transform
+		placements[i].distance = selected[i].Distance
+	}
+	return quadtree, placements, nil
+}
+
+// buildQuadtree tiles the target image with --tileAspectRatio tiles of several sizes
+func buildQuadtree(cmd *cobra.Command, imageSource source.ImageSource, targetImg image.Image) (*image.NRGBA, *manifest, error) {
+	imgIndex, err := openIndex(cmd, tileAspectRatio, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	quadtree, placements, err := selectQuadtree(imgIndex, targetImg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The unsplit tiles are the size of grid tiles
+	pixelsPerUnit := float64(tileMultiple) / float64(int(1)<<quadtree.MaxDepth)
+	dstImg, err := createLayoutOutputImage(targetImg, imageSource, quadtree.Size(), pixelsPerUnit, nil, placements)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dstImg, layoutManifest(placements, pixelsPerUnit), nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/disintegration/imaging"
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/layout"
+	"github.com/timwu/mosaicer/source"
+	"github.com/timwu/mosaicer/util"
+)
+
+// nearestAspectRatio returns the index of the aspect ratio closest to aspectRatio, ignoring orientation
+func nearestAspectRatio(aspectRatio image.Point, aspectRatios []image.Point) int {
+	logRatio := func(p image.Point) float64 {
+		landscape := util.LandscapeAspectRatio(p)
+		return math.Log(float64(landscape.X) / float64(landscape.Y))
+	}
+	nearest := 0
+	for i, candidate := range aspectRatios {
+		if math.Abs(logRatio(candidate)-logRatio(aspectRatio)) < math.Abs(logRatio(aspectRatios[nearest])-logRatio(aspectRatio)) {
+			nearest = i
+		}
+	}
+	return nearest
+}
+
+// openRowsIndexes opens an index for each of the aspect ratios, each searching only the images
+// whose own aspect ratio is nearest to it. Aspect ratios with no such images are dropped.
+func openRowsIndexes(cmd *cobra.Command, aspectRatios []image.Point) (map[image.Point]index.Index, []image.Point, error) {
+	indexes := make(map[image.Point]index.Index)
+	available := make([]image.Point, 0, len(aspectRatios))
+	for _, aspectRatio := range aspectRatios {
+		landscape := util.LandscapeAspectRatio(aspectRatio)
+		if _, ok := indexes[landscape]; !ok {
+			imgIndex, err := openIndex(cmd, aspectRatio, func(sourceAspectRatio image.Point) bool {
+				return util.LandscapeAspectRatio(aspectRatios[nearestAspectRatio(sourceAspectRatio, aspectRatios)]) == landscape
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			// Searching anything shows whether there are images to search
+			candidates, err := imgIndex.SearchTopK(imaging.New(1, 1, image.Black), aspectRatio, 1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(candidates) == 0 {
+				log.Printf("No images are closer to %d:%d than to the other tile aspect ratios, not using it", aspectRatio.X, aspectRatio.Y)
+				imgIndex = nil
+			}
+			indexes[landscape] = imgIndex
+		}
+		if indexes[landscape] != nil {
+			available = append(available, aspectRatio)
+		}
+	}
+	if len(available) == 0 {
+		return nil, nil, fmt.Errorf("no images to use for tile aspect ratios %v", tileAspectRatios)
+	}
+	return indexes, available, nil
+}
+
+// selectRows lays out the target image in rows of tiles of several aspect ratios. Each cell is
+// filled with the best matching of the images that are closest to its aspect ratio.
+func selectRows(cmd *cobra.Command, targetImg image.Image) (*layout.Rows, []placement, error) {
+	aspectRatios := make([]image.Point, len(tileAspectRatios))
+	for i, s := range tileAspectRatios {
+		var err error
+		if aspectRatios[i], err = parseTileAspectRatio(s); err != nil {
+			return nil, nil, err
+		}
+	}
+	indexes, aspectRatios, err := openRowsIndexes(cmd, aspectRatios)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := layout.NewRows(util.AspectRatio(targetImg), aspectRatios, tiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("%d rows of %d units, %d units across", rows.Rows, rows.Unit, rows.Width)
+
+	// Give the reference image enough pixels per unit for the largest sample
+	pixelsPerUnit := 1
+	for _, aspectRatio := range aspectRatios {
+		if y := aspectRatio.Y * referencePatchMultiple; y > pixelsPerUnit*rows.Unit {
+			pixelsPerUnit = (y + rows.Unit - 1) / rows.Unit
+		}
+	}
+	size := rows.Size().Mul(pixelsPerUnit)
+	referenceImg := imaging.Resize(targetImg, size.X, size.Y, imaging.NearestNeighbor)
+
+	// Like the grid, pick at random from the top --fuzziness matches of the best fitting cell
+	uses := newUsageLimiter(maxUses)
+	progressBar := pb.StartNew(rows.Rows)
+	rowPlacements := make([][]placement, rows.Rows)
+	var mu sync.Mutex
+	var selectErr error
+	// Rows compete for images with --maxUses, so select them in order to get the same result every time
+	threads := tileSelectionThreads
+	if maxUses > 0 {
+		threads = 1
+	}
+	limiter := util.NewLimiter(threads)
+	for i := 0; i < rows.Rows; i++ {
+		i := i
+		limiter.Go(func() {
+			defer progressBar.Increment()
+			r := tileRand(image.Point{Y: i})
+			cells, err := rows.Row(i, func(options []layout.Cell) (int, error) {
+				for {
+					best := -1
+					var chosen []index.Candidate
+					for j, option := range options {
+						clip := imaging.Crop(referenceImg, layout.Scale(option.Rect, float64(pixelsPerUnit)))
+						candidates, err := searchAvailable(indexes[util.LandscapeAspectRatio(option.AspectRatio)], clip, option.AspectRatio, uses)
+						if err != nil {
+							return 0, err
+						}
+						if len(candidates) > 0 && (best < 0 || candidates[0].Distance < chosen[0].Distance) {
+							best = j
+							chosen = candidates
+						}
+					}
+					if best < 0 {
+						return 0, fmt.Errorf("no images left for row %d, use a higher --maxUses or fewer --tiles", i)
+					}
+					// Other rows may have used up the candidates since the search, in which case search again
+					if c, ok := uses.pick(chosen, policy, r); ok {
+						rowPlacements[i] = append(rowPlacements[i], placement{name: c.Name, transform: c.Transform, distance: c.Distance})
+						return best, nil
+					}
+				}
+			})
+			if err != nil {
+				mu.Lock()
+				selectErr = err
+				mu.Unlock()
+				return
+			}
+			for j, cell := range cells {
+				rowPlacements[i][j].cell = cell
+			}
+		})
+	}
+	limiter.Close()
+	progressBar.Finish()
+	if selectErr != nil {
+		return nil, nil, selectErr
+	}
+
+	placements := make([]placement, 0)
+	for _, row := range rowPlacements {
+		placements = append(placements, row...)
+	}
+	return rows, placements, nil
+}
+
+// buildRows tiles the target image with rows of tiles of the --tileAspectRatios
+func buildRows(cmd *cobra.Command, imageSource source.ImageSource, targetImg image.Image) (*image.NRGBA, *manifest, error) {
+	rows, placements, err := selectRows(cmd, targetImg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Rows are as tall as the --tileAspectRatio tiles of a grid
+	pixelsPerUnit := float64(tileAspectRatio.Mul(tileMultiple).Y) / float64(rows.Unit)
+	dstImg, err := createLayoutOutputImage(targetImg, imageSource, rows.Size(), pixelsPerUnit, nil, placements)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dstImg, layoutManifest(placements, pixelsPerUnit), nil
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// randomTarget is a blocky image of random colors, so the tiles match different images
+func randomTarget(r *rand.Rand, w, h, block int) *image.NRGBA {
+	img := imaging.New(w, h, color.NRGBA{})
+	for y := 0; y < h; y += block {
+		for x := 0; x < w; x += block {
+			c := color.NRGBA{R: uint8(r.Intn(256)), G: uint8(r.Intn(256)), B: uint8(r.Intn(256)), A: 255}
+			for by := y; by < y+block && by < h; by++ {
+				for bx := x; bx < x+block && bx < w; bx++ {
+					img.SetNRGBA(bx, by, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// indexRandomImages indexes a folder of images of random colors and shapes for each tile aspect ratio
+func indexRandomImages(t *testing.T, aspectRatios ...string) string {
+	dir := filepath.Join(t.TempDir(), "photos")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	sizes := []image.Point{{X: 40, Y: 30}, {X: 30, Y: 40}, {X: 30, Y: 30}, {X: 45, Y: 30}, {X: 64, Y: 36}}
+	for i := 0; i < 40; i++ {
+		size := sizes[i%len(sizes)]
+		if err := imaging.Save(randomTarget(r, size.X, size.Y, 15), filepath.Join(dir, fmt.Sprintf("%d.png", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, aspectRatio := range aspectRatios {
+		runIndex(t, "--tileAspectRatio", aspectRatio, dir)
+	}
+	return dir
+}
+
+// placementNames lists the image and transform of each placement, in the order of their cells
+func placementNames(placements []placement) []string {
+	sorted := append([]placement(nil), placements...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].cell.Rect.Min, sorted[j].cell.Rect.Min
+		return a.Y < b.Y || (a.Y == b.Y && a.X < b.X)
+	})
+	names := make([]string, len(sorted))
+	for i, p := range sorted {
+		names[i] = fmt.Sprintf("%v %s %v", p.cell.Rect, p.name, p.transform)
+	}
+	return names
+}
+
+func TestSeedIgnoresThreads(t *testing.T) {
+	dir := indexRandomImages(t, "4:3", "1:1", "3:2", "16:9")
+	defer func(s []string, sd int64, f, n, threads int, a, p bool, l string) {
+		srcs, seed, fuzziness, tiles, tileSelectionThreads, augment, preload, tileLayout = s, sd, f, n, threads, a, p, l
+	}(srcs, seed, fuzziness, tiles, tileSelectionThreads, augment, preload, tileLayout)
+	defer func(m, d int, on string, threshold float64) {
+		maxUses, maxDepth, splitOn, splitThreshold = m, d, on, threshold
+	}(maxUses, maxDepth, splitOn, splitThreshold)
+	// Each bolt index holds its file open, so load them into memory instead
+	srcs, seed, fuzziness, tiles, augment, preload = []string{dir}, 7, 4, 6, true, true
+	// Splitting on the error searches the index from several threads too
+	maxUses, maxDepth, splitOn, splitThreshold = 0, 1, errorSplit, 50
+	target := randomTarget(rand.New(rand.NewSource(2)), 240, 180, 20)
+
+	builds := map[string]func() ([]string, error){
+		"grid": func() ([]string, error) {
+			imgIndex, err := openIndex(buildCmd, tileAspectRatio, nil)
+			if err != nil {
+				return nil, err
+			}
+			tileNames, _, err := selectImages(imgIndex, target)
+			if err != nil {
+				return nil, err
+			}
+			names := make([]string, 0)
+			for name, gridTiles := range tileNames {
+				for _, t := range gridTiles {
+					names = append(names, fmt.Sprintf("%v %s %v", t.point, name, t.transform))
+				}
+			}
+			sort.Strings(names)
+			return names, nil
+		},
+		"rows": func() ([]string, error) {
+			_, placements, err := selectRows(buildCmd, target)
+			return placementNames(placements), err
+		},
+		"quadtree": func() ([]string, error) {
+			imgIndex, err := openIndex(buildCmd, tileAspectRatio, nil)
+			if err != nil {
+				return nil, err
+			}
+			_, placements, err := selectQuadtree(imgIndex, target)
+			return placementNames(placements), err
+		},
+		"hex": func() ([]string, error) {
+			imgIndex, err := openIndex(buildCmd, tileAspectRatio, nil)
+			if err != nil {
+				return nil, err
+			}
+			tileLayout = hexLayout
+			_, placements, err := selectLattice(imgIndex, target)
+			return placementNames(placements), err
+		},
+	}
+	for name, build := range builds {
+		tileSelectionThreads = 1
+		expected, err := build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tileSelectionThreads = 8
+		actual, err := build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) || len(actual) == 0 {
+			t.Fatalf("%s: selected %d tiles with 8 threads, %d with 1", name, len(actual), len(expected))
+		}
+		for i := range expected {
+			if actual[i] != expected[i] {
+				t.Fatalf("%s: selected %s with 8 threads, %s with 1", name, actual[i], expected[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/timwu/mosaicer/util"
+)
+
+const (
+	noCorrection        = "none"
+	meanCorrection      = "mean"
+	deviationCorrection = "deviation"
+)
+
+// checkCorrection validates the --correction flags
+func checkCorrection() error {
+	if correction != noCorrection && correction != meanCorrection && correction != deviationCorrection {
+		return fmt.Errorf("unknown correction %s, must be one of %s, %s or %s", correction, noCorrection, meanCorrection, deviationCorrection)
+	}
+	if maxCorrection < 0 {
+		return fmt.Errorf("--maxCorrection must not be negative")
+	}
+	return nil
+}
+
+// correctTile shifts the colors of tile toward the part of targetImg under rect, according to
+// --correction. mask, if not nil, is the visible part of the tile.
+func correctTile(tile, targetImg *image.NRGBA, rect image.Rectangle, mask *image.Alpha) *image.NRGBA {
+	if correction == noCorrection {
+		return tile
+	}
+	return util.CorrectColor(tile, cellPatch(targetImg, rect, mask), mask, maxCorrection/distanceScale, correction == deviationCorrection)
+}
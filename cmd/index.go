@@ -15,8 +15,9 @@
 package cmd
 
 import (
-	"image"
+	"fmt"
 	"log"
+	"sync/atomic"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/spf13/cobra"
@@ -33,53 +34,171 @@ var (
 		RunE:  doIndex,
 	}
 
-	nThreads = 4
-	samples  = 4
+	nThreads     = 4
+	samples      = 4
+	forceReindex = false
+	encoding     = index.Float64Encoding
+	rgba         = true
+	subCrops     = 0
+	subCropScale = 70
+
+	indexTileAspectRatio = "4:3"
 )
 
 func init() {
 	indexCmd.Flags().IntVar(&nThreads, "threads", 4, "Number of threads to use for indexing")
 	indexCmd.Flags().IntVar(&samples, "samples", 4, "Number of samples per-image to take")
+	indexCmd.Flags().BoolVar(&forceReindex, "force", false, "Re-analyze every image, even ones that are unchanged since they were last indexed")
+	indexCmd.Flags().StringVar(&encoding, "encoding", index.Float64Encoding, fmt.Sprintf("Encoding of the L*a*b* samples, one of %v. Defaults to the existing index's encoding", index.EncodingNames))
+	indexCmd.Flags().BoolVar(&rgba, "rgba", true, "Also store the RGBA samples, which are not needed for building. Defaults to what the existing index has")
+	indexCmd.Flags().IntVar(&subCrops, "subCrops", 0, "Also index an N by N grid of zoomed in crops of each image, spread from its top left to its bottom right. Each is a separate candidate for the tiles. Defaults to what the existing index has")
+	indexCmd.Flags().IntVar(&subCropScale, "subCropScale", 70, "Size of the --subCrops, as a percentage of the largest crop of the image. Defaults to what the existing index has")
+	indexCmd.PersistentFlags().StringVar(&indexTileAspectRatio, "tileAspectRatio", "4:3", "Aspect ratio to crop images to. Indexes for different aspect ratios are kept side by side")
 	rootCmd.AddCommand(indexCmd)
 }
 
+// indexName is the name of the index for src and the --tileAspectRatio flag
+func indexName(src string) (string, error) {
+	cropAspectRatio, err := parseTileAspectRatio(indexTileAspectRatio)
+	if err != nil {
+		return "", err
+	}
+	return index.Name(src, cropAspectRatio), nil
+}
+
 func doIndex(cmd *cobra.Command, args []string) error {
+	cropAspectRatio, err := parseTileAspectRatio(indexTileAspectRatio)
+	if err != nil {
+		return err
+	}
+	name := index.Name(args[0], cropAspectRatio)
 	imageSource, err := source.NewImageSource(args[0])
 	if err != nil {
 		return err
 	}
-	imageSource = source.NewCropSource(imageSource, image.Point{X: 4, Y: 3})
 	defer imageSource.Close()
 	names, err := imageSource.GetImageNames()
 	if err != nil {
 		return err
 	}
-	boltIndex, err := index.NewBoltIndexBuilder(args[0])
+	existing, err := index.ReadMetadata(name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if !cmd.Flags().Changed("encoding") {
+			encoding = existing.Encoding
+		}
+		if !cmd.Flags().Changed("rgba") {
+			rgba = existing.RGBA
+		}
+		// Otherwise re-indexing without the flags would prune all the sub-crops
+		if !cmd.Flags().Changed("subCrops") {
+			subCrops = existing.SubCrops
+		}
+		if !cmd.Flags().Changed("subCropScale") && existing.SubCropScale > 0 {
+			subCropScale = existing.SubCropScale
+		}
+	}
+	if subCrops < 0 {
+		return fmt.Errorf("--subCrops must not be negative")
+	}
+	if subCropScale <= 0 || subCropScale > 100 {
+		return fmt.Errorf("--subCropScale must be between 1 and 100")
+	}
+	metadata := index.Metadata{
+		Samples:         samples,
+		CropAspectRatio: util.LandscapeAspectRatio(cropAspectRatio),
+		Analyzer:        analysis.SimpleAnalyzer,
+		ColorSpace:      analysis.LabColorSpace,
+		Encoding:        encoding,
+		RGBA:            rgba,
+	}
+	if subCrops > 0 {
+		metadata.SubCrops = subCrops
+		metadata.SubCropScale = subCropScale
+	}
+	// Everything gets re-analyzed when forced, so the existing data doesn't need to match
+	if existing != nil && !forceReindex {
+		if err := existing.Compatible(metadata); err != nil {
+			return fmt.Errorf("%v. Re-run with the same flags to update the index, or with --force to rebuild it", err)
+		}
+	}
+	boltIndex, err := index.NewBoltIndexBuilder(name, metadata)
 	if err != nil {
 		return err
 	}
 	defer boltIndex.Close()
 
+	// Each image is indexed whole, and as each of its sub-crops
+	crops := source.SubCropGrid(metadata.CropAspectRatio, subCrops, subCropScale)
+	indexedNames := make([]string, 0, len(names)*(len(crops)+1))
+	for _, name := range names {
+		indexedNames = append(indexedNames, name)
+		for _, crop := range crops {
+			indexedNames = append(indexedNames, crop.Name(name))
+		}
+	}
+	removed, err := boltIndex.Prune(indexedNames)
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d images that no longer exist", removed)
+
+	var skipped int64
 	limiter := util.NewLimiter(nThreads)
 	progressBar := pb.StartNew(len(names))
 	for _, name := range names {
 		name := name
 		limiter.Go(func() {
 			defer progressBar.Increment()
-			img, err := imageSource.GetImage(name)
+			info, err := imageSource.GetImageInfo(name)
 			if err != nil {
 				log.Fatal(err)
 			}
-			data, err := analysis.Simple(img, samples)
+			imageNames := []string{name}
+			for _, crop := range crops {
+				imageNames = append(imageNames, crop.Name(name))
+			}
+			if !forceReindex {
+				current := true
+				for _, imageName := range imageNames {
+					ok, err := boltIndex.IsCurrent(imageName, info)
+					if err != nil {
+						log.Fatal(err)
+					}
+					current = current && ok
+				}
+				if current {
+					atomic.AddInt64(&skipped, 1)
+					return
+				}
+			}
+			img, err := imageSource.GetImage(name)
 			if err != nil {
 				log.Fatal(err)
 			}
-			if err := boltIndex.Index(name, data); err != nil {
-				log.Fatal(err)
+			for i, imageName := range imageNames {
+				// Sub-crops are already cropped, so their own aspect ratio is the one before cropping
+				cropped := source.CropImageToAspectRatio(img, metadata.CropAspectRatio)
+				sourceAspectRatio := util.AspectRatio(img)
+				if i > 0 {
+					cropped = crops[i-1].Apply(img)
+					sourceAspectRatio = util.AspectRatio(cropped)
+				}
+				data, err := analysis.Simple(cropped, samples)
+				if err != nil {
+					log.Fatal(err)
+				}
+				data.SourceAspectRatio = sourceAspectRatio
+				if err := boltIndex.Index(imageName, info, data); err != nil {
+					log.Fatal(err)
+				}
 			}
 		})
 	}
 	limiter.Close()
 	progressBar.Finish()
+	log.Printf("Skipped %d unchanged images", skipped)
 	return nil
 }
@@ -0,0 +1,121 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/index"
+)
+
+var (
+	exportCmd = &cobra.Command{
+		Use:   "export [source]",
+		Short: "Export an index as line delimited JSON",
+		Args:  cobra.ExactArgs(1),
+		RunE:  doExport,
+	}
+	importCmd = &cobra.Command{
+		Use:   "import [source] [file]",
+		Short: "Import an exported index, use - to read from stdin",
+		Args:  cobra.ExactArgs(2),
+		RunE:  doImport,
+	}
+
+	exportOutput   = ""
+	rewritePrefix  = []string{}
+	importEncoding = ""
+)
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "File to write the export to. Defaults to stdout")
+	importCmd.Flags().StringArrayVar(&rewritePrefix, "rewritePrefix", nil, "Rewrite image names starting with old to start with new instead, given as old=new. Can be repeated, the first matching prefix is used")
+	importCmd.Flags().StringVar(&importEncoding, "encoding", "", fmt.Sprintf("Encoding of the imported L*a*b* samples, one of %v. Defaults to the encoding of the exported index", index.EncodingNames))
+	indexCmd.AddCommand(exportCmd)
+	indexCmd.AddCommand(importCmd)
+}
+
+func doExport(cmd *cobra.Command, args []string) error {
+	name, err := indexName(args[0])
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if exportOutput != "" {
+		f, err := os.Create(exportOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	exported, err := index.Export(name, w)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d images", exported)
+	return nil
+}
+
+// prefixRewriter parses old=new prefix rewrites into a function applying the first that matches
+func prefixRewriter(rewrites []string) (func(string) string, error) {
+	prefixes := make([][2]string, len(rewrites))
+	for i, rewrite := range rewrites {
+		split := strings.SplitN(rewrite, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid prefix rewrite %s, must be old=new", rewrite)
+		}
+		prefixes[i] = [2]string{split[0], split[1]}
+	}
+	return func(name string) string {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix[0]) {
+				return prefix[1] + strings.TrimPrefix(name, prefix[0])
+			}
+		}
+		return name
+	}, nil
+}
+
+func doImport(cmd *cobra.Command, args []string) error {
+	name, err := indexName(args[0])
+	if err != nil {
+		return err
+	}
+	rename, err := prefixRewriter(rewritePrefix)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	imported, err := index.Import(name, r, rename, importEncoding)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d images", imported)
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/util"
+)
+
+var (
+	mergeCmd = &cobra.Command{
+		Use:   "merge [target] [source]...",
+		Short: "Merge the indexes of several sources into one index",
+		Long: "Merge the indexes of several sources into the index for target. Image names are prefixed with their source, " +
+			"so build with the same --source values and --index target to use the merged index.",
+		Args: cobra.MinimumNArgs(2),
+		RunE: doMerge,
+	}
+
+	mergeForce = false
+)
+
+func init() {
+	mergeCmd.Flags().BoolVar(&mergeForce, "force", false, "Replace the target index if it already exists")
+	indexCmd.AddCommand(mergeCmd)
+}
+
+func doMerge(cmd *cobra.Command, args []string) error {
+	defer util.LogTime("merge indexes")()
+	cropAspectRatio, err := parseTileAspectRatio(indexTileAspectRatio)
+	if err != nil {
+		return err
+	}
+	target := index.Name(args[0], cropAspectRatio) + index.Suffix
+	if _, err := os.Stat(target); err == nil {
+		if !mergeForce {
+			return fmt.Errorf("%s already exists, use --force to replace it", target)
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	merged, err := index.Merge(args[0], args[1:], cropAspectRatio)
+	if err != nil {
+		return err
+	}
+	log.Printf("Merged %d images from %d indexes", merged, len(args)-1)
+	return nil
+}
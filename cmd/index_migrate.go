@@ -0,0 +1,65 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/util"
+)
+
+var (
+	migrateCmd = &cobra.Command{
+		Use:   "migrate [source]",
+		Short: "Convert an existing index to a different sample encoding",
+		Args:  cobra.ExactArgs(1),
+		RunE:  doMigrate,
+	}
+
+	migrateEncoding = index.Float32Encoding
+	migrateRGBA     = false
+)
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateEncoding, "encoding", index.Float32Encoding, fmt.Sprintf("Encoding of the L*a*b* samples, one of %v", index.EncodingNames))
+	migrateCmd.Flags().BoolVar(&migrateRGBA, "rgba", false, "Keep the RGBA samples")
+	indexCmd.AddCommand(migrateCmd)
+}
+
+func fileSize(path string) int64 {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fileInfo.Size()
+}
+
+func doMigrate(cmd *cobra.Command, args []string) error {
+	defer util.LogTime("migrate index")()
+	name, err := indexName(args[0])
+	if err != nil {
+		return err
+	}
+	before := fileSize(name + index.Suffix)
+	if err := index.Migrate(name, migrateEncoding, migrateRGBA); err != nil {
+		return err
+	}
+	log.Printf("Index size went from %d to %d bytes", before, fileSize(name+index.Suffix))
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/index"
+)
+
+var (
+	statsCmd = &cobra.Command{
+		Use:   "stats [source]",
+		Short: "Summarize an existing index",
+		Args:  cobra.ExactArgs(1),
+		RunE:  doStats,
+	}
+
+	statsJSON = false
+)
+
+func init() {
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "Output the summary as JSON")
+	indexCmd.AddCommand(statsCmd)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func printStats(w io.Writer, stats *index.Stats) {
+	m := stats.Metadata
+	fmt.Fprintf(w, "Samples: %d, cropped to %d:%d, %s analyzer, %s, %s encoding, RGBA samples: %t\n",
+		m.Samples, m.CropAspectRatio.X, m.CropAspectRatio.Y, m.Analyzer, m.ColorSpace, m.Encoding, m.RGBA)
+	if m.SubCrops > 0 {
+		fmt.Fprintf(w, "Sub-crops: %dx%d at %d%%\n", m.SubCrops, m.SubCrops, m.SubCropScale)
+	}
+	fmt.Fprintf(w, "Images: %d (%d skipped)\n", stats.Images, len(stats.Skipped))
+
+	fmt.Fprintf(w, "\nSample dimensions:\n")
+	for _, d := range stats.Dimensions {
+		fmt.Fprintf(w, "  %dx%d: %d samples, %d bytes\n", d.Width, d.Height, d.Samples, d.Bytes)
+	}
+
+	fmt.Fprintf(w, "\nAspect ratios:\n")
+	aspectRatios := make([]string, 0, len(stats.AspectRatios))
+	for aspectRatio := range stats.AspectRatios {
+		aspectRatios = append(aspectRatios, aspectRatio)
+	}
+	sort.Slice(aspectRatios, func(i, j int) bool {
+		return stats.AspectRatios[aspectRatios[i]] > stats.AspectRatios[aspectRatios[j]]
+	})
+	for _, aspectRatio := range aspectRatios {
+		fmt.Fprintf(w, "  %s: %d\n", aspectRatio, stats.AspectRatios[aspectRatio])
+	}
+
+	if len(stats.Skipped) > 0 {
+		fmt.Fprintf(w, "\nSkipped images:\n")
+		for _, name := range stats.Skipped {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+
+	g := stats.Gamut
+	fmt.Fprintf(w, "\nGamut: L* %.1f to %.1f, a* %.1f to %.1f, b* %.1f to %.1f, %.1f%% of sRGB covered\n",
+		g.MinL, g.MaxL, g.MinA, g.MaxA, g.MinB, g.MaxB, g.Coverage*100)
+
+	fmt.Fprintf(w, "\nBuckets:\n")
+	for _, bucket := range sortedKeys(stats.BucketBytes) {
+		fmt.Fprintf(w, "  %s: %d bytes\n", bucket, stats.BucketBytes[bucket])
+	}
+	fmt.Fprintf(w, "File: %d bytes\n", stats.FileBytes)
+}
+
+func doStats(cmd *cobra.Command, args []string) error {
+	name, err := indexName(args[0])
+	if err != nil {
+		return err
+	}
+	stats, err := index.ReadStats(name)
+	if err != nil {
+		return err
+	}
+	if statsJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	printStats(os.Stdout, stats)
+	return nil
+}
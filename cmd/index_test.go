@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/spf13/pflag"
+	"github.com/timwu/mosaicer/index"
+)
+
+// runIndex runs mosaicer index with args, starting from the default flags like a new process would
+func runIndex(t *testing.T, args ...string) {
+	indexCmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if err := f.Value.Set(f.DefValue); err != nil {
+			t.Fatal(err)
+		}
+		f.Changed = false
+	})
+	rootCmd.SetArgs(append([]string{"index"}, args...))
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReindexKeepsSubCrops(t *testing.T) {
+	// The index is written next to the folder
+	dir := filepath.Join(t.TempDir(), "photos")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a.png", "b.png"} {
+		img := imaging.New(80, 60, color.NRGBA{R: uint8(100 * i), G: 50, B: 50, A: 255})
+		if err := imaging.Save(img, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	images := func() int {
+		stats, err := index.ReadStats(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.Images
+	}
+
+	runIndex(t, "--subCrops", "2", "--subCropScale", "50", dir)
+	if n := images(); n != 10 {
+		t.Fatalf("Indexed %d images, expected 2 images with 4 sub-crops each", n)
+	}
+	metadata, err := index.ReadMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.SubCrops != 2 || metadata.SubCropScale != 50 {
+		t.Fatalf("Expected the sub-crops in the metadata, got %+v", metadata)
+	}
+
+	// A routine re-index keeps the sub-crops the index was built with
+	runIndex(t, dir)
+	if n := images(); n != 10 {
+		t.Fatalf("Re-indexing without --subCrops left %d images, expected 10", n)
+	}
+	if metadata, err = index.ReadMetadata(dir); err != nil || metadata.SubCrops != 2 || metadata.SubCropScale != 50 {
+		t.Fatalf("Expected re-indexing to keep the sub-crops in the metadata, got %+v, %v", metadata, err)
+	}
+
+	runIndex(t, "--subCrops", "0", dir)
+	if n := images(); n != 2 {
+		t.Fatalf("Indexing with --subCrops 0 left %d images, expected 2", n)
+	}
+}
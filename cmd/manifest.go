@@ -0,0 +1,143 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"image"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/layout"
+	"github.com/timwu/mosaicer/source"
+)
+
+// manifestRect is a rectangle in pixels
+type manifestRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func newManifestRect(r image.Rectangle) manifestRect {
+	return manifestRect{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}
+}
+
+// manifestGrid is the shape of a --layout grid mosaic
+type manifestGrid struct {
+	Columns    int `json:"columns"`
+	Rows       int `json:"rows"`
+	TileWidth  int `json:"tile_width"`
+	TileHeight int `json:"tile_height"`
+}
+
+// manifestTile is the image placed in a tile of the mosaic
+type manifestTile struct {
+	// Grid position of the tile, only for --layout grid
+	Column *int `json:"column,omitempty"`
+	Row    *int `json:"row,omitempty"`
+	// Bounds of the tile in the mosaic, which can extend past its edges for --layout brick, offset and hex
+	Rect manifestRect `json:"rect"`
+	// Name of the image or sub-crop that was used, and of the image it is part of
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// Match distance in ΔE for the L*a*b* metrics
+	Distance  float64 `json:"distance"`
+	Transform string  `json:"transform"`
+}
+
+// manifest describes how a mosaic was built, for --manifest
+type manifest struct {
+	Target string `json:"target"`
+	// Part of the target image that was tiled, after --cropImageAspectRatio
+	TargetCrop manifestRect   `json:"target_crop"`
+	Layout     string         `json:"layout"`
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	Grid       *manifestGrid  `json:"grid,omitempty"`
+	Tiles      []manifestTile `json:"tiles"`
+	// Value of every build flag, including the --seed that was used
+	Parameters map[string]string `json:"parameters"`
+}
+
+func newManifestTile(rect image.Rectangle, name string, distance float64, transform index.Transform) manifestTile {
+	return manifestTile{
+		Rect:      newManifestRect(rect),
+		Name:      name,
+		Image:     source.BaseName(name),
+		Distance:  distance * distanceScale,
+		Transform: transform.String(),
+	}
+}
+
+// gridManifest describes the tiles of a --layout grid mosaic, in reading order
+func gridManifest(tileNames map[string][]gridTile, tileCount, tileSize image.Point) *manifest {
+	m := &manifest{
+		Grid:  &manifestGrid{Columns: tileCount.X, Rows: tileCount.Y, TileWidth: tileSize.X, TileHeight: tileSize.Y},
+		Tiles: make([]manifestTile, 0, tileCount.X*tileCount.Y),
+	}
+	for name, gridTiles := range tileNames {
+		for _, t := range gridTiles {
+			loc := image.Point{X: t.point.X * tileSize.X, Y: t.point.Y * tileSize.Y}
+			tile := newManifestTile(image.Rectangle{Min: loc, Max: loc.Add(tileSize)}, name, t.distance, t.transform)
+			column, row := t.point.X, t.point.Y
+			tile.Column, tile.Row = &column, &row
+			m.Tiles = append(m.Tiles, tile)
+		}
+	}
+	sort.Slice(m.Tiles, func(i, j int) bool {
+		if *m.Tiles[i].Row != *m.Tiles[j].Row {
+			return *m.Tiles[i].Row < *m.Tiles[j].Row
+		}
+		return *m.Tiles[i].Column < *m.Tiles[j].Column
+	})
+	return m
+}
+
+// layoutManifest describes the placements of a layout drawn at pixelsPerUnit
+func layoutManifest(placements []placement, pixelsPerUnit float64) *manifest {
+	m := &manifest{Tiles: make([]manifestTile, len(placements))}
+	for i, p := range placements {
+		m.Tiles[i] = newManifestTile(layout.Scale(p.cell.Rect, pixelsPerUnit), p.name, p.distance, p.transform)
+	}
+	return m
+}
+
+// writeManifest fills in the rest of m for the build of target and writes it to path as JSON
+func writeManifest(cmd *cobra.Command, m *manifest, path, target string, targetCrop image.Rectangle, size image.Point) error {
+	m.Target = target
+	m.TargetCrop = newManifestRect(targetCrop)
+	m.Layout = tileLayout
+	m.Width, m.Height = size.X, size.Y
+	m.Parameters = make(map[string]string)
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		m.Parameters[f.Name] = f.Value.String()
+	})
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/layout"
+	"github.com/timwu/mosaicer/source"
+)
+
+func TestGridManifest(t *testing.T) {
+	crop := source.SubCrop{AspectRatio: image.Point{X: 4, Y: 3}, Scale: 70, X: 0, Y: 0}.Name("b.jpg")
+	tileNames := map[string][]gridTile{
+		"a.jpg": {{point: image.Point{X: 1, Y: 1}, distance: 0.05}, {point: image.Point{X: 0, Y: 0}, transform: index.FlipH, distance: 0.1}},
+		crop:    {{point: image.Point{X: 1, Y: 0}, transform: index.Rotate180, distance: 0.02}},
+		"c.jpg": {{point: image.Point{X: 0, Y: 1}, distance: 0.3}},
+	}
+	m := gridManifest(tileNames, image.Point{X: 2, Y: 2}, image.Point{X: 80, Y: 60})
+	if *m.Grid != (manifestGrid{Columns: 2, Rows: 2, TileWidth: 80, TileHeight: 60}) {
+		t.Fatalf("Got grid %+v", *m.Grid)
+	}
+
+	// In reading order, with distances in ΔE
+	expected := []manifestTile{
+		{Rect: manifestRect{X: 0, Y: 0, Width: 80, Height: 60}, Name: "a.jpg", Image: "a.jpg", Distance: 10, Transform: "fliph"},
+		{Rect: manifestRect{X: 80, Y: 0, Width: 80, Height: 60}, Name: crop, Image: "b.jpg", Distance: 2, Transform: "rotate180"},
+		{Rect: manifestRect{X: 0, Y: 60, Width: 80, Height: 60}, Name: "c.jpg", Image: "c.jpg", Distance: 30, Transform: "identity"},
+		{Rect: manifestRect{X: 80, Y: 60, Width: 80, Height: 60}, Name: "a.jpg", Image: "a.jpg", Distance: 5, Transform: "identity"},
+	}
+	if len(m.Tiles) != len(expected) {
+		t.Fatalf("Got %d tiles, expected %d", len(m.Tiles), len(expected))
+	}
+	for i, tile := range m.Tiles {
+		if *tile.Column != i%2 || *tile.Row != i/2 {
+			t.Fatalf("Tile %d is at column %d, row %d", i, *tile.Column, *tile.Row)
+		}
+		tile.Column, tile.Row = nil, nil
+		if math.Abs(tile.Distance-expected[i].Distance) > 1e-9 {
+			t.Fatalf("Tile %d has distance %v, expected %v", i, tile.Distance, expected[i].Distance)
+		}
+		tile.Distance = expected[i].Distance
+		if tile != expected[i] {
+			t.Fatalf("Tile %d is %+v, expected %+v", i, tile, expected[i])
+		}
+	}
+}
+
+func TestLayoutManifest(t *testing.T) {
+	placements := []placement{
+		{cell: layout.Cell{Rect: image.Rect(0, 0, 4, 3)}, name: "a.jpg", distance: 0.1},
+		{cell: layout.Cell{Rect: image.Rect(4, 0, 7, 3)}, name: "b.jpg", transform: index.Transpose, distance: 0.25},
+		// Lattice cells can hang off the edges
+		{cell: layout.Cell{Rect: image.Rect(-2, 3, 2, 6)}, name: "c.jpg", transform: index.FlipV, distance: 0},
+	}
+	m := layoutManifest(placements, 2.5)
+	if m.Grid != nil {
+		t.Fatalf("Only grids should have a grid, got %+v", *m.Grid)
+	}
+
+	// In the order of the placements, scaled to pixels and rounded
+	expected := []manifestTile{
+		{Rect: manifestRect{X: 0, Y: 0, Width: 10, Height: 8}, Name: "a.jpg", Image: "a.jpg", Distance: 10, Transform: "identity"},
+		{Rect: manifestRect{X: 10, Y: 0, Width: 8, Height: 8}, Name: "b.jpg", Image: "b.jpg", Distance: 25, Transform: "transpose"},
+		{Rect: manifestRect{X: -5, Y: 8, Width: 10, Height: 7}, Name: "c.jpg", Image: "c.jpg", Distance: 0, Transform: "flipv"},
+	}
+	if len(m.Tiles) != len(expected) {
+		t.Fatalf("Got %d tiles, expected %d", len(m.Tiles), len(expected))
+	}
+	for i, tile := range m.Tiles {
+		if tile.Column != nil || tile.Row != nil {
+			t.Fatalf("Tile %d has a grid position", i)
+		}
+		if math.Abs(tile.Distance-expected[i].Distance) > 1e-9 {
+			t.Fatalf("Tile %d has distance %v, expected %v", i, tile.Distance, expected[i].Distance)
+		}
+		tile.Distance = expected[i].Distance
+		if tile != expected[i] {
+			t.Fatalf("Tile %d is %+v, expected %+v", i, tile, expected[i])
+		}
+	}
+}
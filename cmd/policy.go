@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/timwu/mosaicer/index"
+)
+
+const (
+	uniformPolicyName   = "uniform"
+	softmaxPolicyName   = "softmax"
+	thresholdPolicyName = "threshold"
+
+	// Distances are reported on the go-colorful scale, where L* is in [0, 1]. The policy flags are
+	// in the usual units, which are ΔE for the L*a*b* metrics.
+	distanceScale = 100.0
+)
+
+// policy is parsed from the --selection flags
+var policy selectionPolicy = uniformPolicy{}
+
+// selectionPolicy picks one of the best matches for a tile at random
+type selectionPolicy interface {
+	// choose returns the index of the candidate to use. There is at least one candidate, and they
+	// are sorted from best to worst match.
+	choose(candidates []index.Candidate, r *rand.Rand) int
+}
+
+// uniformPolicy picks any of the candidates with equal probability
+type uniformPolicy struct{}
+
+func (uniformPolicy) choose(candidates []index.Candidate, r *rand.Rand) int {
+	return r.Intn(len(candidates))
+}
+
+// softmaxPolicy picks better matches more often, weighting each candidate by exp(-d / temperature)
+// for its distance d from the best match
+type softmaxPolicy struct {
+	temperature float64
+}
+
+func (p softmaxPolicy) choose(candidates []index.Candidate, r *rand.Rand) int {
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, candidate := range candidates {
+		weights[i] = math.Exp(-(candidate.Distance - candidates[0].Distance) * distanceScale / p.temperature)
+		total += weights[i]
+	}
+	x := r.Float64() * total
+	for i, weight := range weights {
+		if x < weight {
+			return i
+		}
+		x -= weight
+	}
+	return len(candidates) - 1
+}
+
+// thresholdPolicy picks any of the candidates within threshold of the best match with equal probability
+type thresholdPolicy struct {
+	threshold float64
+}
+
+func (p thresholdPolicy) choose(candidates []index.Candidate, r *rand.Rand) int {
+	n := 1
+	for n < len(candidates) && (candidates[n].Distance-candidates[0].Distance)*distanceScale <= p.threshold {
+		n++
+	}
+	return r.Intn(n)
+}
+
+// newSelectionPolicy creates the policy for the --selection flags
+func newSelectionPolicy() (selectionPolicy, error) {
+	switch selection {
+	case uniformPolicyName:
+		return uniformPolicy{}, nil
+	case softmaxPolicyName:
+		if temperature <= 0 {
+			return nil, fmt.Errorf("--temperature must be positive")
+		}
+		return softmaxPolicy{temperature: temperature}, nil
+	case thresholdPolicyName:
+		if threshold < 0 {
+			return nil, fmt.Errorf("--threshold must not be negative")
+		}
+		return thresholdPolicy{threshold: threshold}, nil
+	}
+	return nil, fmt.Errorf("unknown selection %s, must be one of %s, %s or %s", selection, uniformPolicyName, softmaxPolicyName, thresholdPolicyName)
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/timwu/mosaicer/index"
+)
+
+func withDistances(distances ...float64) []index.Candidate {
+	c := make([]index.Candidate, len(distances))
+	for i, d := range distances {
+		c[i] = index.Candidate{Distance: d}
+	}
+	return c
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     selectionPolicy
+		candidates []index.Candidate
+		// Whether each candidate can be chosen
+		expected []bool
+	}{
+		{"uniform single", uniformPolicy{}, withDistances(0.2), []bool{true}},
+		{"softmax single", softmaxPolicy{temperature: 1}, withDistances(0.2), []bool{true}},
+		{"threshold single", thresholdPolicy{threshold: 0}, withDistances(0.2), []bool{true}},
+		// Distances are on the go-colorful scale, so 0.0625 apart is 6.25 ΔE
+		{"threshold boundary", thresholdPolicy{threshold: 6.25}, withDistances(0.25, 0.3125, 0.375), []bool{true, true, false}},
+		{"threshold below boundary", thresholdPolicy{threshold: 6.24}, withDistances(0.25, 0.3125, 0.375), []bool{true, false, false}},
+		{"threshold ties", thresholdPolicy{threshold: 0}, withDistances(0.25, 0.25, 0.3125), []bool{true, true, false}},
+		{"softmax low temperature", softmaxPolicy{temperature: 0.001}, withDistances(0.25, 0.26, 0.5), []bool{true, false, false}},
+		{"softmax high temperature", softmaxPolicy{temperature: 1000}, withDistances(0.25, 0.26, 0.5), []bool{true, true, true}},
+		{"uniform", uniformPolicy{}, withDistances(0.25, 0.26, 0.5), []bool{true, true, true}},
+	}
+	for _, test := range tests {
+		r := rand.New(rand.NewSource(1))
+		chosen := make([]bool, len(test.candidates))
+		for i := 0; i < 1000; i++ {
+			choice := test.policy.choose(test.candidates, r)
+			if choice < 0 || choice >= len(test.candidates) {
+				t.Fatalf("%s: chose %d of %d candidates", test.name, choice, len(test.candidates))
+			}
+			chosen[choice] = true
+		}
+		for i := range chosen {
+			if chosen[i] != test.expected[i] {
+				t.Fatalf("%s: chose candidates %v, expected %v", test.name, chosen, test.expected)
+			}
+		}
+	}
+}
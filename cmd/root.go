@@ -14,7 +14,13 @@
 
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"fmt"
+	"image"
+
+	"github.com/spf13/cobra"
+	"github.com/timwu/mosaicer/util"
+)
 
 var (
 	rootCmd = &cobra.Command{
@@ -26,3 +32,20 @@ var (
 func Execute() error {
 	return rootCmd.Execute()
 }
+
+// parseTileAspectRatio parses a --tileAspectRatio flag value like 4:3
+func parseTileAspectRatio(tileAspectRatio string) (image.Point, error) {
+	aspectRatio, err := util.ParseAspectRatioString(tileAspectRatio)
+	if err != nil {
+		return image.Point{}, err
+	}
+	if aspectRatio.X <= 0 || aspectRatio.Y <= 0 {
+		return image.Point{}, fmt.Errorf("invalid tile aspect ratio %s", tileAspectRatio)
+	}
+	// Keep the orientation, but reduce so 8:6 searches the same samples as 4:3
+	reduced := util.LandscapeAspectRatio(aspectRatio)
+	if aspectRatio.X < aspectRatio.Y {
+		reduced = image.Point{X: reduced.Y, Y: reduced.X}
+	}
+	return reduced, nil
+}
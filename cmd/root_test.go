@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"image"
+	"testing"
+
+	"github.com/timwu/mosaicer/index"
+)
+
+func TestParseTileAspectRatio(t *testing.T) {
+	tests := []struct {
+		flag     string
+		expected image.Point
+		// Name of the index for the source photos
+		index string
+	}{
+		// 4:3 is what every index was cropped to before there were others
+		{"4:3", image.Point{X: 4, Y: 3}, "photos"},
+		{"8:6", image.Point{X: 4, Y: 3}, "photos"},
+		{"16:9", image.Point{X: 16, Y: 9}, "photos.16x9"},
+		{"1:1", image.Point{X: 1, Y: 1}, "photos.1x1"},
+		// Portrait tiles keep their orientation, but search the landscape index
+		{"3:4", image.Point{X: 3, Y: 4}, "photos"},
+		{"2:3", image.Point{X: 2, Y: 3}, "photos.3x2"},
+		{"6:9", image.Point{X: 2, Y: 3}, "photos.3x2"},
+	}
+	for _, test := range tests {
+		aspectRatio, err := parseTileAspectRatio(test.flag)
+		if err != nil {
+			t.Fatalf("%s: %v", test.flag, err)
+		}
+		if aspectRatio != test.expected {
+			t.Fatalf("%s parsed as %v, expected %v", test.flag, aspectRatio, test.expected)
+		}
+		if name := index.Name("photos", aspectRatio); name != test.index {
+			t.Fatalf("%s uses the index %s, expected %s", test.flag, name, test.index)
+		}
+	}
+
+	for _, flag := range []string{"", "4", "4x3", "4:", "a:3", "4:3:2", "0:3", "4:0", "-4:3"} {
+		if aspectRatio, err := parseTileAspectRatio(flag); err == nil {
+			t.Fatalf("Expected %q to be rejected, got %v", flag, aspectRatio)
+		}
+	}
+}
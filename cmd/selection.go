@@ -0,0 +1,327 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/source"
+	"github.com/timwu/mosaicer/util"
+)
+
+// tileRand is the random number generator for the tile at p, derived from --seed. Each tile gets
+// its own so that its choices don't depend on the order the tiles are selected in.
+func tileRand(p image.Point) *rand.Rand {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, []int64{seed, int64(p.X), int64(p.Y)})
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// usageLimiter caps the number of tiles each image is used for, counting the sub-crops of an image
+// as uses of it. It is safe for concurrent use.
+type usageLimiter struct {
+	mu sync.Mutex
+	// Maximum uses of each image, 0 is unlimited
+	max  int
+	uses map[string]int
+}
+
+func newUsageLimiter(max int) *usageLimiter {
+	return &usageLimiter{
+		max:  max,
+		uses: make(map[string]int),
+	}
+}
+
+// available is whether the image has uses left
+func (u *usageLimiter) available(name string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.max == 0 || u.uses[source.BaseName(name)] < u.max
+}
+
+// pick uses one of the candidates that have uses left, chosen by policy with r. Returns false if
+// they have all run out of uses.
+func (u *usageLimiter) pick(candidates []index.Candidate, policy selectionPolicy, r *rand.Rand) (index.Candidate, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	available := make([]index.Candidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if u.max == 0 || u.uses[source.BaseName(candidate.Name)] < u.max {
+			available = append(available, candidate)
+		}
+	}
+	if len(available) == 0 {
+		return index.Candidate{}, false
+	}
+	candidate := available[policy.choose(available, r)]
+	u.uses[source.BaseName(candidate.Name)]++
+	return candidate, true
+}
+
+// searchAvailable finds the best --fuzziness matches for img that have uses left, searching
+// further down the matches as the best images run out
+func searchAvailable(imgIndex index.Index, img *image.NRGBA, aspectRatio image.Point, uses *usageLimiter) ([]index.Candidate, error) {
+	want := fuzziness
+	if want < 1 {
+		want = 1
+	}
+	for k := want; ; k *= 4 {
+		candidates, err := imgIndex.SearchTopK(img, aspectRatio, k)
+		if err != nil {
+			return nil, err
+		}
+		available := make([]index.Candidate, 0, want)
+		for _, candidate := range candidates {
+			if uses.available(candidate.Name) {
+				available = append(available, candidate)
+				if len(available) == want {
+					break
+				}
+			}
+		}
+		// Fewer than k candidates means there are no more to search
+		if len(available) == want || len(candidates) < k {
+			return available, nil
+		}
+	}
+}
+
+// repeatGrid tracks the image assigned to each tile of a grid, to keep repeats of an image apart.
+// Sub-crops of an image count as repeats of it.
+type repeatGrid struct {
+	// Chebyshev distance in tiles that an image can't be repeated within
+	radius int
+	names  [][]string
+}
+
+func newRepeatGrid(tileCount image.Point, radius int) *repeatGrid {
+	names := make([][]string, tileCount.Y)
+	for i := range names {
+		names[i] = make([]string, tileCount.X)
+	}
+	return &repeatGrid{radius: radius, names: names}
+}
+
+// nearby is whether name is already assigned to a tile within the radius of p. A nil repeatGrid
+// allows any repeats.
+func (g *repeatGrid) nearby(name string, p image.Point) bool {
+	if g == nil {
+		return false
+	}
+	for y := p.Y - g.radius; y <= p.Y+g.radius; y++ {
+		if y < 0 || y >= len(g.names) {
+			continue
+		}
+		for x := p.X - g.radius; x <= p.X+g.radius; x++ {
+			if x >= 0 && x < len(g.names[y]) && g.names[y][x] == source.BaseName(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g *repeatGrid) assign(name string, p image.Point) {
+	if g == nil {
+		return
+	}
+	g.names[p.Y][p.X] = source.BaseName(name)
+}
+
+// tileSearch is the best matches for a tile, searched for before the tiles are assigned
+type tileSearch struct {
+	point image.Point
+	clip  *image.NRGBA
+	// Number of matches searched for, there are fewer candidates if the index ran out
+	k          int
+	candidates []index.Candidate
+}
+
+// searchTiles finds the best matches for each of the tiles concurrently
+func searchTiles(imgIndex index.Index, searches []*tileSearch, aspectRatio image.Point) {
+	log.Printf("searching for tile matches")
+	progressBar := pb.StartNew(len(searches))
+	limiter := util.NewLimiter(tileSelectionThreads)
+	for _, t := range searches {
+		t := t
+		limiter.Go(func() {
+			defer progressBar.Increment()
+			var err error
+			if t.candidates, err = imgIndex.SearchTopK(t.clip, aspectRatio, t.k); err != nil {
+				log.Fatalf("i=%d,j=%d err=%v", t.point.Y, t.point.X, err)
+			}
+			if len(t.candidates) == 0 {
+				log.Fatalf("i=%d,j=%d err=no images in the index", t.point.Y, t.point.X)
+			}
+		})
+	}
+	limiter.Close()
+	progressBar.Finish()
+}
+
+// assignTiles picks an image for each of the searched tiles according to --assignment. Returns the
+// candidate for each of the searches.
+func assignTiles(imgIndex index.Index, searches []*tileSearch, aspectRatio image.Point, uses *usageLimiter, repeats *repeatGrid) ([]index.Candidate, error) {
+	var selected []index.Candidate
+	if assignment == optimalAssignment {
+		var err error
+		if selected, err = assignOptimal(imgIndex, searches, aspectRatio, uses, repeats); err != nil {
+			return nil, err
+		}
+	} else {
+		// The tiles with the closest matches get the first pick of the images
+		order := make([]int, len(searches))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return searches[order[i]].candidates[0].Distance < searches[order[j]].candidates[0].Distance
+		})
+		selected = make([]index.Candidate, len(searches))
+		for _, i := range order {
+			var err error
+			if selected[i], err = assignTile(imgIndex, searches[i], aspectRatio, uses, repeats); err != nil {
+				return nil, err
+			}
+		}
+	}
+	totalDistance := 0.0
+	for _, candidate := range selected {
+		totalDistance += candidate.Distance
+	}
+	log.Printf("Average match distance %.4f", totalDistance/float64(len(selected)))
+	return selected, nil
+}
+
+// initialK is how many matches to search each tile for up front. For optimal assignment this is
+// the candidates each tile can be assigned to. Otherwise each neighbor within
+// --minRepeatDistance can rule out at most one of them, so this leaves --fuzziness to pick from
+// unless --maxUses rules out more. Annealing also needs --candidates to move each tile between.
+func initialK() int {
+	if assignment == optimalAssignment {
+		return assignmentCandidates
+	}
+	k := fuzziness
+	if k < 1 {
+		k = 1
+	}
+	if minRepeatDistance > 0 {
+		k += (2*minRepeatDistance+1)*(2*minRepeatDistance+1) - 1
+	}
+	if annealing() && k < assignmentCandidates {
+		k = assignmentCandidates
+	}
+	return k
+}
+
+// assignTile picks at random from the best --fuzziness matches for the tile that have uses left and
+// are not repeated nearby, searching further down the matches if the ones found up front run out.
+// It is not safe for concurrent use, since the assignments depend on each other.
+func assignTile(imgIndex index.Index, t *tileSearch, aspectRatio image.Point, uses *usageLimiter, repeats *repeatGrid) (index.Candidate, error) {
+	want := fuzziness
+	if want < 1 {
+		want = 1
+	}
+	for {
+		allowed := make([]index.Candidate, 0, want)
+		for _, candidate := range t.candidates {
+			if uses.available(candidate.Name) && !repeats.nearby(candidate.Name, t.point) {
+				allowed = append(allowed, candidate)
+				if len(allowed) == want {
+					break
+				}
+			}
+		}
+		if len(allowed) == want || len(t.candidates) < t.k {
+			candidate, ok := uses.pick(allowed, policy, tileRand(t.point))
+			if !ok && repeats == nil {
+				return index.Candidate{}, fmt.Errorf("no images left for the tile at %v that are used fewer than --maxUses %d times", t.point, uses.max)
+			}
+			if !ok {
+				return index.Candidate{}, fmt.Errorf("no images left for the tile at %v that are used fewer than --maxUses %d times and not repeated within --minRepeatDistance %d",
+					t.point, uses.max, repeats.radius)
+			}
+			repeats.assign(candidate.Name, t.point)
+			return candidate, nil
+		}
+		t.k *= 4
+		var err error
+		if t.candidates, err = imgIndex.SearchTopK(t.clip, aspectRatio, t.k); err != nil {
+			return index.Candidate{}, err
+		}
+	}
+}
+
+// assignOptimal assigns the tiles to the candidates that minimize the total distance, using each
+// image for at most --maxUses tiles. Tiles that can't be given any of their candidates fall back
+// to assignTile. Returns the candidate for each of the searches.
+func assignOptimal(imgIndex index.Index, searches []*tileSearch, aspectRatio image.Point, uses *usageLimiter, repeats *repeatGrid) ([]index.Candidate, error) {
+	defer util.LogTime("optimal assignment")()
+	// Sub-crops share the uses of their image, so they are all the same column
+	columns := make(map[string]int)
+	rows := make([][]util.AssignmentEdge, len(searches))
+	for i, t := range searches {
+		for _, candidate := range t.candidates {
+			column, ok := columns[source.BaseName(candidate.Name)]
+			if !ok {
+				column = len(columns)
+				columns[source.BaseName(candidate.Name)] = column
+			}
+			rows[i] = append(rows[i], util.AssignmentEdge{Column: column, Cost: candidate.Distance})
+		}
+	}
+	assigned := util.MinCostAssignment(rows, len(columns), uses.max)
+
+	selected := make([]index.Candidate, len(searches))
+	unassigned := 0
+	for i, column := range assigned {
+		if column == util.Unassigned {
+			continue
+		}
+		// The candidates are sorted by distance, so this finds the one the assignment used
+		for _, candidate := range searches[i].candidates {
+			if columns[source.BaseName(candidate.Name)] == column {
+				selected[i] = candidate
+				break
+			}
+		}
+		uses.pick([]index.Candidate{selected[i]}, uniformPolicy{}, tileRand(searches[i].point))
+		repeats.assign(selected[i].Name, searches[i].point)
+	}
+	for i, column := range assigned {
+		if column != util.Unassigned {
+			continue
+		}
+		unassigned++
+		var err error
+		if selected[i], err = assignTile(imgIndex, searches[i], aspectRatio, uses, repeats); err != nil {
+			return nil, err
+		}
+	}
+	if unassigned > 0 {
+		log.Printf("%d tiles had no candidates left with --candidates %d, used the next best matches", unassigned, assignmentCandidates)
+	}
+	return selected, nil
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+
+	"github.com/timwu/mosaicer/index"
+	"github.com/timwu/mosaicer/source"
+)
+
+// firstPolicy always picks the best candidate
+type firstPolicy struct{}
+
+func (firstPolicy) choose(candidates []index.Candidate, r *rand.Rand) int {
+	return 0
+}
+
+func candidates(names ...string) []index.Candidate {
+	c := make([]index.Candidate, len(names))
+	for i, name := range names {
+		c[i] = index.Candidate{Name: name, Distance: float64(i+1) / 100}
+	}
+	return c
+}
+
+func TestUsageLimiterPick(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	crop := source.SubCrop{AspectRatio: image.Point{X: 4, Y: 3}, Scale: 70, X: 0, Y: 0}.Name("a.jpg")
+	uses := newUsageLimiter(2)
+	// Sub-crops of an image count as uses of it
+	picks := []struct {
+		candidates []index.Candidate
+		expected   string
+		ok         bool
+	}{
+		{candidates("a.jpg", "b.jpg"), "a.jpg", true},
+		{candidates(crop, "b.jpg"), crop, true},
+		{candidates("a.jpg", "b.jpg"), "b.jpg", true},
+		{candidates(crop), "", false},
+		{candidates("a.jpg", crop, "b.jpg"), "b.jpg", true},
+		{candidates("a.jpg", "b.jpg"), "", false},
+		{candidates(), "", false},
+	}
+	for i, p := range picks {
+		candidate, ok := uses.pick(p.candidates, firstPolicy{}, r)
+		if ok != p.ok || candidate.Name != p.expected {
+			t.Fatalf("Pick %d got %q, %t, expected %q, %t", i, candidate.Name, ok, p.expected, p.ok)
+		}
+	}
+	if uses.available("a.jpg") || uses.available(crop) || !uses.available("c.jpg") {
+		t.Fatalf("Expected only c.jpg to be available, got uses %v", uses.uses)
+	}
+
+	unlimited := newUsageLimiter(0)
+	for i := 0; i < 10; i++ {
+		if candidate, ok := unlimited.pick(candidates("a.jpg"), firstPolicy{}, r); !ok || candidate.Name != "a.jpg" {
+			t.Fatalf("Pick %d of an unlimited image failed", i)
+		}
+	}
+}
+
+func TestRepeatGridNearby(t *testing.T) {
+	g := newRepeatGrid(image.Point{X: 5, Y: 4}, 1)
+	g.assign("a.jpg", image.Point{X: 0, Y: 0})
+	g.assign(source.SubCrop{AspectRatio: image.Point{X: 4, Y: 3}, Scale: 70, X: 50, Y: 50}.Name("b.jpg"), image.Point{X: 4, Y: 3})
+	tests := []struct {
+		name     string
+		p        image.Point
+		expected bool
+	}{
+		{"a.jpg", image.Point{X: 0, Y: 0}, true},
+		{"a.jpg", image.Point{X: 1, Y: 1}, true},
+		{"a.jpg", image.Point{X: 0, Y: 1}, true},
+		{"a.jpg", image.Point{X: 2, Y: 0}, false},
+		{"a.jpg", image.Point{X: 0, Y: 2}, false},
+		{"c.jpg", image.Point{X: 1, Y: 0}, false},
+		// Repeats of an image and its sub-crops are kept apart, up to the edges of the grid
+		{"b.jpg", image.Point{X: 3, Y: 2}, true},
+		{source.SubCrop{AspectRatio: image.Point{X: 4, Y: 3}, Scale: 70, X: 0, Y: 0}.Name("b.jpg"), image.Point{X: 4, Y: 2}, true},
+		{"b.jpg", image.Point{X: 4, Y: 1}, false},
+		{"b.jpg", image.Point{X: 2, Y: 3}, false},
+	}
+	for _, test := range tests {
+		if nearby := g.nearby(test.name, test.p); nearby != test.expected {
+			t.Fatalf("nearby(%s, %v) = %t, expected %t", test.name, test.p, nearby, test.expected)
+		}
+	}
+
+	var none *repeatGrid
+	none.assign("a.jpg", image.Point{})
+	if none.nearby("a.jpg", image.Point{}) {
+		t.Fatalf("A nil repeatGrid should allow any repeats")
+	}
+}
+
+// searchedTiles is a row of tiles that have each been searched for the candidates
+func searchedTiles(tileCandidates ...[]index.Candidate) []*tileSearch {
+	searches := make([]*tileSearch, len(tileCandidates))
+	for i, c := range tileCandidates {
+		// Fewer candidates than k means the index has no more, so it is never searched again
+		searches[i] = &tileSearch{point: image.Point{X: i}, k: len(c) + 1, candidates: c}
+	}
+	return searches
+}
+
+func names(selected []index.Candidate) []string {
+	n := make([]string, len(selected))
+	for i, c := range selected {
+		n[i] = c.Name
+	}
+	return n
+}
+
+func TestAssignTilesGreedy(t *testing.T) {
+	defer func(f int, p selectionPolicy) { fuzziness, policy = f, p }(fuzziness, policy)
+	fuzziness, policy = 1, uniformPolicy{}
+	c := func(name string, distance float64) index.Candidate {
+		return index.Candidate{Name: name, Distance: distance}
+	}
+
+	// The tile with the closest match picks first, so the middle tile gets a.jpg
+	searches := searchedTiles(
+		[]index.Candidate{c("a.jpg", 0.1), c("b.jpg", 0.2)},
+		[]index.Candidate{c("a.jpg", 0.05), c("b.jpg", 0.3), c("c.jpg", 0.4)},
+		[]index.Candidate{c("a.jpg", 0.2), c("b.jpg", 0.25), c("c.jpg", 0.3)},
+	)
+	tests := []struct {
+		maxUses           int
+		minRepeatDistance int
+		expected          []string
+	}{
+		{0, 0, []string{"a.jpg", "a.jpg", "a.jpg"}},
+		{1, 0, []string{"b.jpg", "a.jpg", "c.jpg"}},
+		{0, 1, []string{"b.jpg", "a.jpg", "b.jpg"}},
+		{2, 2, []string{"b.jpg", "a.jpg", "c.jpg"}},
+	}
+	for _, test := range tests {
+		selected, err := assignTiles(nil, searches, image.Point{X: 4, Y: 3}, newUsageLimiter(test.maxUses), newRepeatGrid(image.Point{X: 3, Y: 1}, test.minRepeatDistance))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(selected); got[0] != test.expected[0] || got[1] != test.expected[1] || got[2] != test.expected[2] {
+			t.Fatalf("--maxUses %d --minRepeatDistance %d assigned %v, expected %v", test.maxUses, test.minRepeatDistance, got, test.expected)
+		}
+	}
+
+	// Running out of candidates is an error rather than leaving a tile empty
+	searches = searchedTiles(
+		[]index.Candidate{c("a.jpg", 0.1), c("b.jpg", 0.2)},
+		[]index.Candidate{c("a.jpg", 0.05)},
+		[]index.Candidate{c("a.jpg", 0.2), c("b.jpg", 0.25)},
+	)
+	if _, err := assignTiles(nil, searches, image.Point{X: 4, Y: 3}, newUsageLimiter(1), nil); err == nil {
+		t.Fatalf("Expected an error when every candidate is used up")
+	}
+	if _, err := assignTiles(nil, searches, image.Point{X: 4, Y: 3}, newUsageLimiter(0), newRepeatGrid(image.Point{X: 3, Y: 1}, 2)); err == nil {
+		t.Fatalf("Expected an error when every candidate is repeated nearby")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/timwu/mosaicer/util"
+)
+
+const (
+	colorTone     = "color"
+	grayscaleTone = "grayscale"
+	duotoneTone   = "duotone"
+)
+
+// newToneMap creates the rendering of the output image for the --tone flags, or nil to keep its colors
+func newToneMap() (func(img *image.NRGBA) *image.NRGBA, error) {
+	switch tone {
+	case colorTone:
+		return nil, nil
+	case grayscaleTone:
+		return func(img *image.NRGBA) *image.NRGBA {
+			return util.ToneMap(img, colorful.Color{}, colorful.Color{R: 1, G: 1, B: 1})
+		}, nil
+	case duotoneTone:
+		shadow, err := colorful.Hex(shadowColor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --shadowColor %s: %v", shadowColor, err)
+		}
+		highlight, err := colorful.Hex(highlightColor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --highlightColor %s: %v", highlightColor, err)
+		}
+		return func(img *image.NRGBA) *image.NRGBA {
+			return util.ToneMap(img, shadow, highlight)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown tone %s, must be one of %s, %s or %s", tone, colorTone, grayscaleTone, duotoneTone)
+}
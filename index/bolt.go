@@ -17,11 +17,11 @@ package index
 import (
 	"fmt"
 	"image"
-	"math/rand"
-	"sort"
+	"sync"
 
-	"github.com/disintegration/imaging"
 	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
+	"github.com/timwu/mosaicer/util"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -29,30 +29,62 @@ import (
 // v1
 // - names
 //   - int key -> string name
-// - data
+// - ids
+//   - string name -> int key
+// - info
+//   - int key -> image info bytes
+// - aspect_ratios
+//   - int key -> aspect ratio of the image before cropping
+// - meta (see metadata.go)
+// - data (only if the metadata has RGBA set)
 //   - dimensions
 //     - int key -> rgba bytes
 // - lab_data
 //   - dimensions
-//     - int key -> lab bytes
+//     - int key -> lab bytes, in the encoding from the metadata
 var (
-	indexSuffix = ".index.bolt"
+	// Suffix is appended to the source path to name its index file
+	Suffix = ".index.bolt"
 
-	rootKey    = []byte("v1")
-	namesKey   = []byte("names")
-	dataKey    = []byte("data")
-	labDataKey = []byte("lab_data")
+	rootKey         = []byte("v1")
+	namesKey        = []byte("names")
+	idsKey          = []byte("ids")
+	infoKey         = []byte("info")
+	aspectRatiosKey = []byte("aspect_ratios")
+	dataKey         = []byte("data")
+	labDataKey      = []byte("lab_data")
 )
 
+// Name is the name of the index for source with images cropped to cropAspectRatio. It can be passed
+// anywhere else in this package that takes a source. Indexes for different crop aspect ratios live
+// side by side, with 4:3 using the unqualified source name that predates other aspect ratios.
+func Name(source string, cropAspectRatio image.Point) string {
+	aspectRatio := util.LandscapeAspectRatio(cropAspectRatio)
+	if aspectRatio == legacyCropAspectRatio {
+		return source
+	}
+	return fmt.Sprintf("%s.%dx%d", source, aspectRatio.X, aspectRatio.Y)
+}
+
 func boltDB(source string) (*bolt.DB, error) {
-	return bolt.Open(source+indexSuffix, 0666, nil)
+	return bolt.Open(source+Suffix, 0666, nil)
 }
 
 type boltIndexBuilder struct {
-	db *bolt.DB
+	db       *bolt.DB
+	metadata Metadata
+	encoding labEncoding
 }
 
+// addName returns the existing id for name, or allocates a new one
 func addName(name string, rootBucket *bolt.Bucket) (int, error) {
+	idsBucket, err := rootBucket.CreateBucketIfNotExists(idsKey)
+	if err != nil {
+		return 0, err
+	}
+	if id := idsBucket.Get([]byte(name)); id != nil {
+		return bytesToInt(id), nil
+	}
 	namesBucket, err := rootBucket.CreateBucketIfNotExists(namesKey)
 	if err != nil {
 		return 0, err
@@ -61,24 +93,107 @@ func addName(name string, rootBucket *bolt.Bucket) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	// There can be duplicates, just don't repeat the same dataset?
+	if err := idsBucket.Put([]byte(name), intToBytes(int(id))); err != nil {
+		return 0, err
+	}
 	return int(id), namesBucket.Put(intToBytes(int(id)), []byte(name))
 }
 
-func (b *boltIndexBuilder) Index(name string, data *analysis.ImageData) error {
-	// Don't bother storing images with no samples
-	if len(data.Samples) == 0 {
+// removeSamples deletes the samples for id from every dimension bucket under the given bucket key
+func removeSamples(id int, rootBucket *bolt.Bucket, key []byte) error {
+	bucket := rootBucket.Bucket(key)
+	if bucket == nil {
 		return nil
 	}
+	return bucket.ForEach(func(k, v []byte) error {
+		// Only nested buckets have a nil value
+		if v != nil {
+			return nil
+		}
+		return bucket.Bucket(k).Delete(intToBytes(id))
+	})
+}
+
+// removeID deletes everything stored for id
+func removeID(id int, rootBucket *bolt.Bucket) error {
+	for _, key := range [][]byte{namesKey, infoKey, aspectRatiosKey} {
+		if bucket := rootBucket.Bucket(key); bucket != nil {
+			if err := bucket.Delete(intToBytes(id)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := removeSamples(id, rootBucket, dataKey); err != nil {
+		return err
+	}
+	return removeSamples(id, rootBucket, labDataKey)
+}
+
+func (b *boltIndexBuilder) Index(name string, info source.ImageInfo, data *analysis.ImageData) error {
 	return b.db.Batch(func(tx *bolt.Tx) error {
-		rootBucket, err := tx.CreateBucketIfNotExists(rootKey)
+		return b.indexImage(tx, name, info, data)
+	})
+}
+
+// indexedImage is an image waiting to be written by indexAll
+type indexedImage struct {
+	name string
+	info source.ImageInfo
+	data *analysis.ImageData
+}
+
+// indexAll writes the images in a single transaction. Index batches concurrent calls, but a
+// single writer would wait out the batch delay for every image.
+func (b *boltIndexBuilder) indexAll(images []indexedImage) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, img := range images {
+			if err := b.indexImage(tx, img.name, img.info, img.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// indexImage writes the data for name within tx, replacing any existing data
+func (b *boltIndexBuilder) indexImage(tx *bolt.Tx, name string, info source.ImageInfo, data *analysis.ImageData) error {
+	rootBucket, err := tx.CreateBucketIfNotExists(rootKey)
+	if err != nil {
+		return err
+	}
+	id, err := addName(name, rootBucket)
+	if err != nil {
+		return err
+	}
+	infoBucket, err := rootBucket.CreateBucketIfNotExists(infoKey)
+	if err != nil {
+		return err
+	}
+	if err := infoBucket.Put(intToBytes(id), infoToBytes(info)); err != nil {
+		return err
+	}
+	if data.SourceAspectRatio != (image.Point{}) {
+		aspectRatiosBucket, err := rootBucket.CreateBucketIfNotExists(aspectRatiosKey)
 		if err != nil {
 			return err
 		}
-		id, err := addName(name, rootBucket)
-		if err != nil {
+		if err := aspectRatiosBucket.Put(intToBytes(id), pointToBytes(data.SourceAspectRatio)); err != nil {
 			return err
 		}
+	}
+	// Clear out samples from any previous version of the image
+	if err := removeSamples(id, rootBucket, dataKey); err != nil {
+		return err
+	}
+	if err := removeSamples(id, rootBucket, labDataKey); err != nil {
+		return err
+	}
+	// Don't bother storing images with no samples. The info is still kept so the image
+	// isn't analyzed again until it changes.
+	if len(data.LabSamples) == 0 {
+		return nil
+	}
+	if b.metadata.RGBA {
 		dataBucket, err := rootBucket.CreateBucketIfNotExists(dataKey)
 		if err != nil {
 			return err
@@ -92,43 +207,179 @@ func (b *boltIndexBuilder) Index(name string, data *analysis.ImageData) error {
 				return err
 			}
 		}
-		labDataBucket, err := rootBucket.CreateBucketIfNotExists(labDataKey)
+	}
+	labDataBucket, err := rootBucket.CreateBucketIfNotExists(labDataKey)
+	if err != nil {
+		return err
+	}
+	for size, sample := range data.LabSamples {
+		dimensionBucket, err := labDataBucket.CreateBucketIfNotExists(pointToBytes(size))
 		if err != nil {
 			return err
 		}
-		for size, sample := range data.LabSamples {
-			dimensionBucket, err := labDataBucket.CreateBucketIfNotExists(pointToBytes(size))
-			if err != nil {
+		if err := dimensionBucket.Put(intToBytes(id), b.encoding.encode(sample)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltIndexBuilder) IsCurrent(name string, info source.ImageInfo) (bool, error) {
+	current := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return nil
+		}
+		idsBucket := rootBucket.Bucket(idsKey)
+		infoBucket := rootBucket.Bucket(infoKey)
+		if idsBucket == nil || infoBucket == nil {
+			return nil
+		}
+		id := idsBucket.Get([]byte(name))
+		if id == nil {
+			return nil
+		}
+		if existing := infoBucket.Get(id); existing != nil {
+			existingInfo := bytesToInfo(existing)
+			current = existingInfo.Size == info.Size && existingInfo.ModTime.Equal(info.ModTime)
+		}
+		return nil
+	})
+	return current, err
+}
+
+func (b *boltIndexBuilder) Prune(names []string) (int, error) {
+	keep := make(map[string]bool)
+	for _, name := range names {
+		keep[name] = true
+	}
+	removed := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return nil
+		}
+		idsBucket := rootBucket.Bucket(idsKey)
+		if idsBucket == nil {
+			return nil
+		}
+		stale := make(map[string]int)
+		if err := idsBucket.ForEach(func(k, v []byte) error {
+			if !keep[string(k)] {
+				stale[string(k)] = bytesToInt(v)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for name, id := range stale {
+			if err := idsBucket.Delete([]byte(name)); err != nil {
 				return err
 			}
-			if err := dimensionBucket.Put(intToBytes(id), floatsToBytes(sample)); err != nil {
+			if err := removeID(id, rootBucket); err != nil {
 				return err
 			}
 		}
+		removed = len(stale)
 		return nil
 	})
+	return removed, err
 }
 
 func (b *boltIndexBuilder) Close() error {
 	return b.db.Close()
 }
 
-// NewBoltIndexBuilder Creates a Bolt index builder
-func NewBoltIndexBuilder(source string) (Builder, error) {
+// migrateIDs builds the name -> id bucket for indexes written before it existed. Older
+// indexes may contain the same name several times, only the latest copy is kept.
+func migrateIDs(tx *bolt.Tx) error {
+	rootBucket := tx.Bucket(rootKey)
+	if rootBucket == nil || rootBucket.Bucket(idsKey) != nil {
+		return nil
+	}
+	namesBucket := rootBucket.Bucket(namesKey)
+	if namesBucket == nil {
+		return nil
+	}
+	idsBucket, err := rootBucket.CreateBucket(idsKey)
+	if err != nil {
+		return err
+	}
+	latest := make(map[string]int)
+	duplicates := make([]int, 0)
+	if err := namesBucket.ForEach(func(k, v []byte) error {
+		id := bytesToInt(k)
+		if previous, ok := latest[string(v)]; ok {
+			if previous > id {
+				duplicates = append(duplicates, id)
+				return nil
+			}
+			duplicates = append(duplicates, previous)
+		}
+		latest[string(v)] = id
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, id := range duplicates {
+		if err := removeID(id, rootBucket); err != nil {
+			return err
+		}
+	}
+	for name, id := range latest {
+		if err := idsBucket.Put([]byte(name), intToBytes(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewBoltIndexBuilder Creates a Bolt index builder. Re-indexing into an existing index
+// replaces the data for images that are indexed again. metadata describes how the data
+// being indexed was built, check it is Compatible with any existing index first.
+func NewBoltIndexBuilder(source string, metadata Metadata) (Builder, error) {
+	return newBoltIndexBuilder(source, metadata)
+}
+
+func newBoltIndexBuilder(source string, metadata Metadata) (*boltIndexBuilder, error) {
+	encoding, err := getEncoding(metadata.Encoding)
+	if err != nil {
+		return nil, err
+	}
 	db, err := boltDB(source)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := migrateIDs(tx); err != nil {
+			return err
+		}
+		rootBucket, err := tx.CreateBucketIfNotExists(rootKey)
+		if err != nil {
+			return err
+		}
+		return writeMetadata(metadata, rootBucket)
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
 	builder := &boltIndexBuilder{
-		db: db,
+		db:       db,
+		metadata: metadata,
+		encoding: encoding,
 	}
 	return builder, nil
 }
 
 type boltIndex struct {
-	db        *bolt.DB
-	multiple  int
-	fuzziness int
+	db       *bolt.DB
+	options  Options
+	encoding labEncoding
+
+	searchersMu sync.Mutex
+	// searchers by sample dimensions, built lazily on first use
+	searchers map[image.Point]searcher
 }
 
 func getName(id int, rootBucket *bolt.Bucket) (string, error) {
@@ -143,26 +394,14 @@ func getName(id int, rootBucket *bolt.Bucket) (string, error) {
 	return string(name), nil
 }
 
-func getDistances(dataBucket *bolt.Bucket, size image.Point, bytes []byte, idDistances map[int]float64) error {
-	query := analysis.RGBAToLab(bytes)
-	dimensionBucket := dataBucket.Bucket(pointToBytes(size))
-	if dimensionBucket == nil {
-		return fmt.Errorf("dimension bucket not found: %v", size)
-	}
-	return dimensionBucket.ForEach(func(k, v []byte) error {
-		id := bytesToInt(k)
-		idDistances[id] = floatDistance(query, bytesToFloats(v))
-		return nil
-	})
-}
-
-func (b *boltIndex) Search(img *image.NRGBA, aspectRatio image.Point) (string, error) {
-	selected := ""
-	size := aspectRatio.Mul(b.multiple)
-	if b.multiple == 0 {
-		size = image.Point{X: 1, Y: 1}
+// searcher returns the searcher for the given sample dimensions, loading it from the db if needed
+func (b *boltIndex) searcher(size image.Point) (searcher, error) {
+	b.searchersMu.Lock()
+	defer b.searchersMu.Unlock()
+	if s := b.searchers[size]; s != nil {
+		return s, nil
 	}
-	resized := imaging.Resize(img, size.X, size.Y, imaging.NearestNeighbor)
+	var s searcher
 	if err := b.db.View(func(tx *bolt.Tx) error {
 		rootBucket := tx.Bucket(rootKey)
 		if rootBucket == nil {
@@ -172,51 +411,62 @@ func (b *boltIndex) Search(img *image.NRGBA, aspectRatio image.Point) (string, e
 		if dataBucket == nil {
 			return fmt.Errorf("data bucket not found")
 		}
-
-		idDistances := make(map[int]float64)
-		if err := getDistances(dataBucket, size, resized.Pix, idDistances); err != nil {
-			return err
-		}
-		// If the image is not square, also consider the rotated version
-		if size.X != size.Y {
-			rotated := imaging.Rotate90(resized)
-			if err := getDistances(dataBucket, rotated.Rect.Size(), rotated.Pix, idDistances); err != nil {
-				return err
-			}
+		dimensionBucket := dataBucket.Bucket(pointToBytes(size))
+		if dimensionBucket == nil {
+			return fmt.Errorf("dimension bucket not found: %v", size)
 		}
+		var err error
+		s, err = loadSearcher(dimensionBucket, b.encoding, b.options.metric(), sourceAspectRatioFilter(rootBucket, b.options))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	b.searchers[size] = s
+	return s, nil
+}
 
-		ids := make([]int, len(idDistances))
-		i := 0
-		for id := range idDistances {
-			ids[i] = id
-			i++
-		}
-		sort.Slice(ids, func(i, j int) bool {
-			return idDistances[ids[i]] < idDistances[ids[j]]
-		})
+func (b *boltIndex) Search(img *image.NRGBA, aspectRatio image.Point) (string, error) {
+	return searchFuzzy(b, img, aspectRatio, b.options.Fuzziness, b.options.Seed)
+}
 
+func (b *boltIndex) SearchTopK(img *image.NRGBA, aspectRatio image.Point, k int) ([]Candidate, error) {
+	neighbors, err := searchSamples(img, aspectRatio, b.options.Multiple, k, b.options.Approximation, b.options.Augment, b.searcher)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Candidate
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return fmt.Errorf("root bucket not found")
+		}
 		var err error
-		selected, err = getName(ids[rand.Intn(b.fuzziness)], rootBucket)
+		candidates, err = toCandidates(neighbors, func(id int) (string, error) {
+			return getName(id, rootBucket)
+		})
 		return err
 	}); err != nil {
-		return "", err
-	}
-	if selected == "" {
-		return selected, fmt.Errorf("no matching image found")
+		return nil, err
 	}
-	return selected, nil
+	return candidates, nil
 }
 
 // NewBoltIndex creates a bolt index for searching
-func NewBoltIndex(source string, multiple, fuzziness int) (Index, error) {
-	db, err := boltDB(source)
+func NewBoltIndex(source string, options Options) (Index, error) {
+	db, metadata, err := openSearchDB(source, options.Multiple)
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := getEncoding(metadata.Encoding)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 	index := &boltIndex{
 		db:        db,
-		multiple:  multiple,
-		fuzziness: fuzziness,
+		options:   options,
+		encoding:  encoding,
+		searchers: make(map[image.Point]searcher),
 	}
 	return index, nil
 }
@@ -0,0 +1,201 @@
+package index
+
+import (
+	"image"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
+	bolt "go.etcd.io/bbolt"
+)
+
+var testMetadata = Metadata{
+	Samples:         1,
+	CropAspectRatio: image.Point{X: 4, Y: 3},
+	Analyzer:        analysis.SimpleAnalyzer,
+	ColorSpace:      analysis.LabColorSpace,
+	Encoding:        Float64Encoding,
+}
+
+// testImageData is a single 1x1 sample of the given L*
+func testImageData(l float64) *analysis.ImageData {
+	return &analysis.ImageData{
+		AspectRatio: image.Point{X: 4, Y: 3},
+		LabSamples:  map[image.Point][]float64{{X: 1, Y: 1}: {l, 0, 0}},
+	}
+}
+
+// indexTestImages indexes each of the names into a new index in a temp directory, and returns its source
+func indexTestImages(t *testing.T, names ...string) string {
+	src := filepath.Join(t.TempDir(), "photos")
+	builder, err := NewBoltIndexBuilder(src, testMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+	for i, name := range names {
+		info := source.ImageInfo{Size: int64(100 + i), ModTime: time.Unix(1000, 0)}
+		if err := builder.Index(name, info, testImageData(float64(i)/10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src
+}
+
+// storedIDs is the id of each name in the ids bucket, and which ids have a name, info and a sample
+func storedIDs(t *testing.T, src string) (map[string]int, map[int]int) {
+	db, err := boltDB(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ids := make(map[string]int)
+	// Number of the buckets each id has an entry in
+	entries := make(map[int]int)
+	if err := db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if err := rootBucket.Bucket(idsKey).ForEach(func(k, v []byte) error {
+			ids[string(k)] = bytesToInt(v)
+			return nil
+		}); err != nil {
+			return err
+		}
+		buckets := []*bolt.Bucket{
+			rootBucket.Bucket(namesKey),
+			rootBucket.Bucket(infoKey),
+			rootBucket.Bucket(labDataKey).Bucket(pointToBytes(image.Point{X: 1, Y: 1})),
+		}
+		for _, bucket := range buckets {
+			if err := bucket.ForEach(func(k, v []byte) error {
+				entries[bytesToInt(k)]++
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ids, entries
+}
+
+func TestIsCurrent(t *testing.T) {
+	src := indexTestImages(t, "a.jpg")
+	builder, err := NewBoltIndexBuilder(src, testMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+
+	indexed := source.ImageInfo{Size: 100, ModTime: time.Unix(1000, 0)}
+	tests := []struct {
+		name     string
+		info     source.ImageInfo
+		expected bool
+	}{
+		{"a.jpg", indexed, true},
+		{"a.jpg", source.ImageInfo{Size: 100, ModTime: time.Unix(1001, 0)}, false},
+		{"a.jpg", source.ImageInfo{Size: 101, ModTime: indexed.ModTime}, false},
+		{"b.jpg", indexed, false},
+	}
+	for _, test := range tests {
+		current, err := builder.IsCurrent(test.name, test.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != test.expected {
+			t.Fatalf("IsCurrent(%s, %+v) = %t, expected %t", test.name, test.info, current, test.expected)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	src := indexTestImages(t, "a.jpg", "b.jpg", "c.jpg")
+	before, _ := storedIDs(t, src)
+
+	builder, err := NewBoltIndexBuilder(src, testMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := builder.Prune([]string{"b.jpg", "d.jpg"})
+	builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("Removed %d images, expected 2", removed)
+	}
+
+	ids, entries := storedIDs(t, src)
+	if len(ids) != 1 || ids["b.jpg"] != before["b.jpg"] {
+		t.Fatalf("Expected only b.jpg to keep its id %d, got %v", before["b.jpg"], ids)
+	}
+	if len(entries) != 1 || entries[before["b.jpg"]] != 3 {
+		t.Fatalf("Expected only the name, info and sample of b.jpg to be left, got entries for ids %v", entries)
+	}
+}
+
+func TestMigrateIDs(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "photos")
+	db, err := boltDB(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Older indexes allocated a new id each time an image was indexed, and had no ids bucket
+	names := map[int]string{1: "a.jpg", 2: "b.jpg", 3: "a.jpg"}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		rootBucket, err := tx.CreateBucket(rootKey)
+		if err != nil {
+			return err
+		}
+		namesBucket, err := rootBucket.CreateBucket(namesKey)
+		if err != nil {
+			return err
+		}
+		infoBucket, err := rootBucket.CreateBucket(infoKey)
+		if err != nil {
+			return err
+		}
+		labDataBucket, err := rootBucket.CreateBucket(labDataKey)
+		if err != nil {
+			return err
+		}
+		dimensionBucket, err := labDataBucket.CreateBucket(pointToBytes(image.Point{X: 1, Y: 1}))
+		if err != nil {
+			return err
+		}
+		for id, name := range names {
+			if err := namesBucket.Put(intToBytes(id), []byte(name)); err != nil {
+				return err
+			}
+			if err := infoBucket.Put(intToBytes(id), infoToBytes(source.ImageInfo{Size: 100})); err != nil {
+				return err
+			}
+			if err := dimensionBucket.Put(intToBytes(id), floatsToBytes([]float64{0, 0, 0})); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Opening a builder migrates the index
+	builder, err := NewBoltIndexBuilder(src, testMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.Close()
+
+	ids, entries := storedIDs(t, src)
+	if len(ids) != 2 || ids["a.jpg"] != 3 || ids["b.jpg"] != 2 {
+		t.Fatalf("Expected the latest id of each name, got %v", ids)
+	}
+	if entries[1] != 0 || entries[2] != 3 || entries[3] != 3 {
+		t.Fatalf("Expected the duplicate id 1 to be removed, got entries for ids %v", entries)
+	}
+}
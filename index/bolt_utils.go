@@ -18,6 +18,9 @@ import (
 	"encoding/binary"
 	"image"
 	"math"
+	"time"
+
+	"github.com/timwu/mosaicer/source"
 )
 
 func pointToBytes(point image.Point) []byte {
@@ -59,3 +62,16 @@ func bytesToFloats(in []byte) []float64 {
 	}
 	return floats
 }
+
+func infoToBytes(info source.ImageInfo) []byte {
+	bytes := make([]byte, binary.MaxVarintLen64*2)
+	sizeSize := binary.PutVarint(bytes, info.Size)
+	timeSize := binary.PutVarint(bytes[sizeSize:], info.ModTime.UnixNano())
+	return bytes[:sizeSize+timeSize]
+}
+
+func bytesToInfo(bytes []byte) source.ImageInfo {
+	size, sizeSize := binary.Varint(bytes)
+	modTime, _ := binary.Varint(bytes[sizeSize:])
+	return source.ImageInfo{Size: size, ModTime: time.Unix(0, modTime)}
+}
@@ -15,52 +15,221 @@
 package index
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/lucasb-eyer/go-colorful"
 )
 
-type sample []uint8
+// DistanceFunc compares two lab samples of the same size. The samples are packed L*a*b* triples as
+// produced by analysis.RGBAToLab, and the result is the average distance per pixel.
+type DistanceFunc func(left, right []float64) float64
 
-func sq(f float64) float64 {
-	return f * f
+// Metric is a named DistanceFunc
+type Metric struct {
+	Name     string
+	Distance DistanceFunc
+	// Whether Distance satisfies the triangle inequality. Searches with other metrics can't use the
+	// search tree and fall back to comparing against every sample.
+	TriangleInequality bool
 }
 
-func basicDistance(left, right []uint8) float64 {
-	redDiff := float64(left[0]) - float64(right[0])
-	greenDiff := float64(left[1]) - float64(right[1])
-	blueDiff := float64(left[2]) - float64(right[2])
-	return math.Sqrt(redDiff*redDiff + greenDiff*greenDiff + blueDiff*blueDiff)
-}
+// MetricNames lists the names accepted by ParseMetric
+var MetricNames = []string{"cie76", "cie94", "ciede2000", "redmean", "weighted", "luminance"}
 
-func redmeanDistance(left, right []uint8) float64 {
-	redMean := (float64(left[0]) + float64(right[0])) / 2.0
-	redDiff := float64(left[0]) - float64(right[0])
-	greenDiff := float64(left[1]) - float64(right[1])
-	blueDiff := float64(left[2]) - float64(right[2])
+// CIE76 is the euclidean distance in L*a*b*
+var CIE76 = Metric{Name: "cie76", Distance: floatDistance, TriangleInequality: true}
 
-	return math.Sqrt((2.0+redMean/256.0)*redDiff*redDiff + 4*greenDiff*greenDiff + (2+(255.0-redMean)/256.0)*blueDiff*blueDiff)
+// ParseMetric looks up a metric by name. The lightness and chroma weights are only used by the
+// weighted metric, and the contrast weight by the luminance metric.
+func ParseMetric(name string, lightnessWeight, chromaWeight, contrastWeight float64) (Metric, error) {
+	switch name {
+	case "cie76":
+		return CIE76, nil
+	case "cie94":
+		return Metric{Name: name, Distance: cie94Distance}, nil
+	case "ciede2000":
+		return Metric{Name: name, Distance: ciede2000Distance}, nil
+	case "redmean":
+		// Scaled like the L*a*b* metrics, so the thresholds in ΔE mean about the same
+		return Metric{Name: name, Distance: func(left, right []float64) float64 {
+			return redmeanDistance(left, right) / redmeanScale
+		}}, nil
+	case "weighted":
+		if lightnessWeight <= 0 || chromaWeight <= 0 {
+			return Metric{}, fmt.Errorf("weights must be positive")
+		}
+		return Metric{Name: name, Distance: weightedDistance(lightnessWeight, chromaWeight), TriangleInequality: true}, nil
+	case "luminance":
+		if contrastWeight < 0 {
+			return Metric{}, fmt.Errorf("contrast weight must not be negative")
+		}
+		return Metric{Name: name, Distance: luminanceDistance(contrastWeight), TriangleInequality: true}, nil
+	}
+	return Metric{}, fmt.Errorf("unknown metric %s, must be one of %v", name, MetricNames)
 }
 
-func bytesToColor(bytes []uint8) colorful.Color {
-	return colorful.Color{R: float64(bytes[0]) / 255.0, G: float64(bytes[1]) / 255.0, B: float64(bytes[2]) / 255.0}
+func sq(f float64) float64 {
+	return f * f
 }
 
-func distance(left, right sample) float64 {
-	var sumSquares float64
-	for i := 0; i < len(left); i += 4 {
-		leftColor := bytesToColor(left[i : i+4])
-		rightColor := bytesToColor(right[i : i+4])
-		d := leftColor.DistanceLab(rightColor)
-		sumSquares += d
+func floatDistance(left, right []float64) float64 {
+	var totalDistance float64
+	for i := 0; i < len(left); i += 3 {
+		totalDistance += math.Sqrt(sq(left[i]-right[i]) + sq(left[i+1]-right[i+1]) + sq(left[i+2]-right[i+2]))
 	}
-	return sumSquares
+	return totalDistance / float64(len(left)/3)
 }
 
-func floatDistance(left, right []float64) float64 {
+// perPixel averages the distance computed by f over each pixel of the samples
+func perPixel(left, right []float64, f func(l1, a1, b1, l2, a2, b2 float64) float64) float64 {
 	var totalDistance float64
 	for i := 0; i < len(left); i += 3 {
-		totalDistance += math.Sqrt(sq(left[i]-right[i]) + sq(left[i+1]-right[i+1]) + sq(left[i+2]-right[i+2]))
+		totalDistance += f(left[i], left[i+1], left[i+2], right[i], right[i+1], right[i+2])
 	}
 	return totalDistance / float64(len(left)/3)
 }
+
+func weightedDistance(lightnessWeight, chromaWeight float64) DistanceFunc {
+	return func(left, right []float64) float64 {
+		return perPixel(left, right, func(l1, a1, b1, l2, a2, b2 float64) float64 {
+			return math.Sqrt(lightnessWeight*sq(l1-l2) + chromaWeight*(sq(a1-a2)+sq(b1-b2)))
+		})
+	}
+}
+
+// luminanceDistance compares only L*, ignoring color, so that a colorful image with the right
+// lightness can match a monochrome one. The difference in the standard deviation of L* across the
+// samples, which is their contrast, is added with contrastWeight.
+func luminanceDistance(contrastWeight float64) DistanceFunc {
+	return func(left, right []float64) float64 {
+		n := float64(len(left) / 3)
+		var total, leftSum, rightSum, leftSquares, rightSquares float64
+		for i := 0; i < len(left); i += 3 {
+			total += math.Abs(left[i] - right[i])
+			leftSum += left[i]
+			rightSum += right[i]
+			leftSquares += left[i] * left[i]
+			rightSquares += right[i] * right[i]
+		}
+		distance := total / n
+		if contrastWeight > 0 {
+			deviation := func(sum, squares float64) float64 {
+				return math.Sqrt(math.Max(0, squares/n-sq(sum/n)))
+			}
+			distance += contrastWeight * math.Abs(deviation(leftSum, leftSquares)-deviation(rightSum, rightSquares))
+		}
+		return distance
+	}
+}
+
+// redmeanScale is the redmean distance from black to white, which is 1 in L*a*b* as go-colorful
+// scales it, or 100 ΔE
+var redmeanScale = redmeanDistance([]float64{0, 0, 0}, []float64{1, 0, 0})
+
+func redmeanDistance(left, right []float64) float64 {
+	return perPixel(left, right, func(l1, a1, b1, l2, a2, b2 float64) float64 {
+		c1 := colorful.Lab(l1, a1, b1).Clamped()
+		c2 := colorful.Lab(l2, a2, b2).Clamped()
+		redMean := (c1.R + c2.R) * 255.0 / 2.0
+		redDiff := (c1.R - c2.R) * 255.0
+		greenDiff := (c1.G - c2.G) * 255.0
+		blueDiff := (c1.B - c2.B) * 255.0
+		return math.Sqrt((2.0+redMean/256.0)*redDiff*redDiff+4*greenDiff*greenDiff+(2+(255.0-redMean)/256.0)*blueDiff*blueDiff) / 255.0
+	})
+}
+
+// The samples are stored with L* in [0, 1] as go-colorful does, while the CIE94 and CIEDE2000
+// formulas are defined for L* in [0, 100]. labScale converts between the two.
+const labScale = 100.0
+
+func cie94Distance(left, right []float64) float64 {
+	return perPixel(left, right, func(l1, a1, b1, l2, a2, b2 float64) float64 {
+		return cie94(l1*labScale, a1*labScale, b1*labScale, l2*labScale, a2*labScale, b2*labScale) / labScale
+	})
+}
+
+// cie94 is the graphic arts CIE94 color difference, using the first color as the reference
+func cie94(l1, a1, b1, l2, a2, b2 float64) float64 {
+	const k1, k2 = 0.045, 0.015
+	c1 := math.Hypot(a1, b1)
+	c2 := math.Hypot(a2, b2)
+	deltaL := l1 - l2
+	deltaC := c1 - c2
+	deltaH2 := math.Max(0, sq(a1-a2)+sq(b1-b2)-sq(deltaC))
+	sc := 1 + k1*c1
+	sh := 1 + k2*c1
+	return math.Sqrt(sq(deltaL) + sq(deltaC/sc) + deltaH2/sq(sh))
+}
+
+func ciede2000Distance(left, right []float64) float64 {
+	return perPixel(left, right, func(l1, a1, b1, l2, a2, b2 float64) float64 {
+		return ciede2000(l1*labScale, a1*labScale, b1*labScale, l2*labScale, a2*labScale, b2*labScale) / labScale
+	})
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// hueAngle is the hue in degrees in [0, 360)
+func hueAngle(a, b float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// ciede2000 is the CIEDE2000 color difference, following Sharma, Wu and Dalal's implementation notes
+func ciede2000(l1, a1, b1, l2, a2, b2 float64) float64 {
+	pow25to7 := math.Pow(25, 7)
+	cBar7 := math.Pow((math.Hypot(a1, b1)+math.Hypot(a2, b2))/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+pow25to7)))
+	a1p := a1 * (1 + g)
+	a2p := a2 * (1 + g)
+	c1p := math.Hypot(a1p, b1)
+	c2p := math.Hypot(a2p, b2)
+	h1p := hueAngle(a1p, b1)
+	h2p := hueAngle(a2p, b2)
+
+	deltaLp := l2 - l1
+	deltaCp := c2p - c1p
+	deltahp := 0.0
+	if c1p*c2p != 0 {
+		deltahp = h2p - h1p
+		if deltahp > 180 {
+			deltahp -= 360
+		} else if deltahp < -180 {
+			deltahp += 360
+		}
+	}
+	deltaHp := 2 * math.Sqrt(c1p*c2p) * math.Sin(radians(deltahp/2))
+
+	lBarp := (l1 + l2) / 2
+	cBarp := (c1p + c2p) / 2
+	hBarp := h1p + h2p
+	if c1p*c2p != 0 {
+		if math.Abs(h1p-h2p) <= 180 {
+			hBarp = (h1p + h2p) / 2
+		} else if h1p+h2p < 360 {
+			hBarp = (h1p + h2p + 360) / 2
+		} else {
+			hBarp = (h1p + h2p - 360) / 2
+		}
+	}
+
+	t := 1 - 0.17*math.Cos(radians(hBarp-30)) + 0.24*math.Cos(radians(2*hBarp)) +
+		0.32*math.Cos(radians(3*hBarp+6)) - 0.20*math.Cos(radians(4*hBarp-63))
+	deltaTheta := 30 * math.Exp(-sq((hBarp-275)/25))
+	cBarp7 := math.Pow(cBarp, 7)
+	rc := 2 * math.Sqrt(cBarp7/(cBarp7+pow25to7))
+	sl := 1 + 0.015*sq(lBarp-50)/math.Sqrt(20+sq(lBarp-50))
+	sc := 1 + 0.045*cBarp
+	sh := 1 + 0.015*cBarp*t
+	rt := -math.Sin(radians(2*deltaTheta)) * rc
+	return math.Sqrt(sq(deltaLp/sl) + sq(deltaCp/sc) + sq(deltaHp/sh) + rt*(deltaCp/sc)*(deltaHp/sh))
+}
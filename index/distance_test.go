@@ -0,0 +1,100 @@
+package index
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestCIEDE2000(t *testing.T) {
+	// Test pairs from Sharma, Wu and Dalal
+	pairs := []struct {
+		l1, a1, b1, l2, a2, b2, expected float64
+	}{
+		{50.0000, 2.6772, -79.7751, 50.0000, 0.0000, -82.7485, 2.0425},
+		{50.0000, 0.0000, 0.0000, 50.0000, -1.0000, 2.0000, 2.3669},
+		{50.0000, 2.5000, 0.0000, 73.0000, 25.0000, -18.0000, 27.1492},
+		{60.2574, -34.0099, 36.2677, 60.4626, -34.1751, 39.4387, 1.2644},
+		{22.7233, 20.0904, -46.6940, 23.0331, 14.9730, -42.5619, 2.0373},
+	}
+	for _, p := range pairs {
+		if actual := ciede2000(p.l1, p.a1, p.b1, p.l2, p.a2, p.b2); math.Abs(actual-p.expected) > 0.0001 {
+			t.Fatalf("Got wrong CIEDE2000 distance for %v, got %v", p, actual)
+		}
+		if actual := ciede2000(p.l2, p.a2, p.b2, p.l1, p.a1, p.b1); math.Abs(actual-p.expected) > 0.0001 {
+			t.Fatalf("Got wrong reversed CIEDE2000 distance for %v, got %v", p, actual)
+		}
+	}
+}
+
+func TestCIE94(t *testing.T) {
+	if actual := cie94(50, 10, 10, 50, 10, 10); actual != 0 {
+		t.Fatalf("Identical colors should have no distance, got %v", actual)
+	}
+	if actual := cie94(50, 10, 10, 40, 10, 10); math.Abs(actual-10) > 1e-9 {
+		t.Fatalf("Lightness only difference should be unweighted, got %v", actual)
+	}
+	// Chroma differences are discounted for saturated reference colors
+	if cie94(50, 80, 0, 50, 70, 0) >= cie94(50, 10, 0, 50, 0, 0) {
+		t.Fatalf("Chroma difference should be smaller for the saturated reference")
+	}
+}
+
+func TestLinearScanMatchesTree(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	vectors := randomVectors(r, 500, 3*4)
+	ids := make([]int, len(vectors))
+	for i := range ids {
+		ids[i] = i
+	}
+	for _, name := range []string{"weighted", "luminance"} {
+		metric, err := ParseMetric(name, 2, 0.5, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := newVPTree(ids, vectors, metric.Distance)
+		scan := &linearScan{ids: ids, vectors: vectors, distance: metric.Distance}
+		for _, query := range randomVectors(r, 20, 3*4) {
+			expected := scan.search(query, 5, 0)
+			actual := tree.search(query, 5, 0)
+			for i := range expected {
+				if expected[i].distance != actual[i].distance {
+					t.Fatalf("%s: result %d differs, tree=%v scan=%v", name, i, actual[i], expected[i])
+				}
+			}
+		}
+	}
+}
+
+func TestLuminanceDistance(t *testing.T) {
+	// A colorful sample with the right lightness matches exactly
+	if d := luminanceDistance(0)([]float64{50, 0, 0, 50, 0, 0}, []float64{50, 60, -40, 50, -20, 70}); d != 0 {
+		t.Fatalf("Colors should be ignored, got distance %v", d)
+	}
+	// Samples with the same average lightness only differ in contrast
+	flat := []float64{50, 0, 0, 50, 0, 0}
+	textured := []float64{40, 0, 0, 60, 0, 0}
+	if d := luminanceDistance(0)(flat, textured); d != 10 {
+		t.Fatalf("Wrong distance without contrast, got %v, expected 10", d)
+	}
+	if d := luminanceDistance(2)(flat, textured); math.Abs(d-30) > 1e-9 {
+		t.Fatalf("Wrong distance with contrast, got %v, expected 30", d)
+	}
+}
+
+func TestRedmeanScale(t *testing.T) {
+	redmean, err := ParseMetric("redmean", 1, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Black to white is 100 ΔE in either metric
+	black, white := []float64{0, 0, 0}, []float64{1, 0, 0}
+	if actual, expected := redmean.Distance(black, white), CIE76.Distance(black, white); math.Abs(actual-expected) > 1e-9 {
+		t.Fatalf("redmean distance from black to white is %v, expected %v", actual, expected)
+	}
+	// L* of 50 is about halfway in both
+	gray := []float64{0.5, 0, 0}
+	if actual := redmean.Distance(black, gray); actual < 0.2 || actual > 0.6 {
+		t.Fatalf("redmean distance from black to gray is %v, expected it on the same scale as CIE76", actual)
+	}
+}
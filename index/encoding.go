@@ -0,0 +1,99 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Encodings of the lab_data samples
+const (
+	// Float64Encoding stores each component as a big endian float64. Indexes without an encoding
+	// in their metadata use this.
+	Float64Encoding = "float64"
+	// Float32Encoding stores each component as a big endian float32
+	Float32Encoding = "float32"
+	// Uint8Encoding quantizes each component to a byte. L* is scaled to [0, 255] and a*, b* are
+	// stored in steps of 1 from -128 to 127 in the usual 0-100 L*a*b* scale.
+	Uint8Encoding = "uint8"
+)
+
+// EncodingNames lists the valid lab sample encodings
+var EncodingNames = []string{Float64Encoding, Float32Encoding, Uint8Encoding}
+
+type labEncoding struct {
+	encode func(floats []float64) []byte
+	decode func(in []byte) []float64
+}
+
+var labEncodings = map[string]labEncoding{
+	Float64Encoding: {encode: floatsToBytes, decode: bytesToFloats},
+	Float32Encoding: {encode: floatsToFloat32Bytes, decode: float32BytesToFloats},
+	Uint8Encoding:   {encode: quantizeLab, decode: dequantizeLab},
+}
+
+func getEncoding(name string) (labEncoding, error) {
+	if name == "" {
+		name = Float64Encoding
+	}
+	encoding, ok := labEncodings[name]
+	if !ok {
+		return labEncoding{}, fmt.Errorf("unknown encoding %s, must be one of %v", name, EncodingNames)
+	}
+	return encoding, nil
+}
+
+func floatsToFloat32Bytes(floats []float64) []byte {
+	buf := make([]byte, len(floats)*4)
+	for i, f := range floats {
+		binary.BigEndian.PutUint32(buf[i*4:], math.Float32bits(float32(f)))
+	}
+	return buf
+}
+
+func float32BytesToFloats(in []byte) []float64 {
+	floats := make([]float64, len(in)/4)
+	for i := range floats {
+		floats[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(in[i*4:])))
+	}
+	return floats
+}
+
+func clampByte(f float64) byte {
+	return byte(math.Max(0, math.Min(255, math.Round(f))))
+}
+
+// The samples have L* in [0, 1] and a*, b* roughly in [-1, 1], see labScale
+func quantizeLab(floats []float64) []byte {
+	buf := make([]byte, len(floats))
+	for i := 0; i < len(floats); i += 3 {
+		buf[i] = clampByte(floats[i] * 255)
+		buf[i+1] = clampByte(floats[i+1]*labScale + 128)
+		buf[i+2] = clampByte(floats[i+2]*labScale + 128)
+	}
+	return buf
+}
+
+func dequantizeLab(in []byte) []float64 {
+	floats := make([]float64, len(in))
+	for i := 0; i < len(in); i += 3 {
+		floats[i] = float64(in[i]) / 255
+		floats[i+1] = (float64(in[i+1]) - 128) / labScale
+		floats[i+2] = (float64(in[i+2]) - 128) / labScale
+	}
+	return floats
+}
@@ -0,0 +1,47 @@
+package index
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/timwu/mosaicer/analysis"
+)
+
+func TestEncodingsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	pix := make([]uint8, 4*64)
+	r.Read(pix)
+	lab := analysis.RGBAToLab(pix)
+
+	// Maximum error per component for each encoding
+	tolerances := map[string]float64{
+		Float64Encoding: 0,
+		Float32Encoding: 1e-6,
+		Uint8Encoding:   0.5 / labScale,
+	}
+	for name, tolerance := range tolerances {
+		encoding, err := getEncoding(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := encoding.decode(encoding.encode(lab))
+		if len(decoded) != len(lab) {
+			t.Fatalf("%s: got %d components, expected %d", name, len(decoded), len(lab))
+		}
+		for i := range lab {
+			if math.Abs(decoded[i]-lab[i]) > tolerance {
+				t.Fatalf("%s: component %d decoded to %v, expected %v", name, i, decoded[i], lab[i])
+			}
+		}
+	}
+}
+
+func TestUnknownEncoding(t *testing.T) {
+	if _, err := getEncoding("float16"); err == nil {
+		t.Fatalf("Expected an error for an unknown encoding")
+	}
+	if _, err := getEncoding(""); err != nil {
+		t.Fatalf("Missing encoding should default to float64, got %v", err)
+	}
+}
@@ -17,94 +17,105 @@ package index
 import (
 	"fmt"
 	"image"
-	"math/rand"
-	"sort"
 
-	"github.com/disintegration/imaging"
-	"github.com/timwu/mosaicer/storage"
 	"github.com/timwu/mosaicer/util"
+	bolt "go.etcd.io/bbolt"
 )
 
 type inMemoryIndex struct {
-	keyToID   map[string]int
-	idToKey   []string
-	multiple  int
-	fuzziness int
-	// all the sample data, maps from aspect ratio -> samples by id
-	samples map[image.Point]map[int]sample
+	names   map[int]string
+	options Options
+	// searchers over the lab samples, by sample dimensions
+	searchers map[image.Point]searcher
 }
 
-func toSample(img *image.NRGBA) sample {
-	nBytes := img.Rect.Size().X * img.Rect.Size().Y * 4
-	if len(img.Pix) == nBytes {
-		return img.Pix
+func (i *inMemoryIndex) searcher(size image.Point) (searcher, error) {
+	s := i.searchers[size]
+	if s == nil {
+		return nil, fmt.Errorf("dimension bucket not found: %v", size)
 	}
-	panic("Wrong byte size!")
+	return s, nil
 }
 
 func (i *inMemoryIndex) Search(img *image.NRGBA, aspectRatio image.Point) (string, error) {
-	size := img.Rect.Size()
-	if i.multiple == 0 {
-		if size.X != 1 || size.Y != 1 {
-			return "", fmt.Errorf("incorrectly sized image. Expecting 1x1. Got %v", size)
-		}
-	} else if (i.multiple*aspectRatio.X != size.X) || (i.multiple*aspectRatio.Y != size.Y) {
-		return "", fmt.Errorf("incorrectly sized image")
-	}
+	return searchFuzzy(i, img, aspectRatio, i.options.Fuzziness, i.options.Seed)
+}
 
-	testSample := toSample(img)
-	idDistances := make(map[int]float64)
-	ids := make([]int, 0)
-	for id := range i.samples[aspectRatio] {
-		idDistances[id] = distance(testSample, i.samples[aspectRatio][id])
-		ids = append(ids, id)
+func (i *inMemoryIndex) SearchTopK(img *image.NRGBA, aspectRatio image.Point, k int) ([]Candidate, error) {
+	neighbors, err := searchSamples(img, aspectRatio, i.options.Multiple, k, i.options.Approximation, i.options.Augment, i.searcher)
+	if err != nil {
+		return nil, err
 	}
-
-	sort.Slice(ids, func(i, j int) bool {
-		return idDistances[ids[i]] < idDistances[ids[j]]
+	return toCandidates(neighbors, func(id int) (string, error) {
+		name, ok := i.names[id]
+		if !ok {
+			return "", fmt.Errorf("name not found for id %d", id)
+		}
+		return name, nil
 	})
+}
 
-	return i.idToKey[ids[rand.Intn(i.fuzziness)]], nil
+// isMultipleSize is whether the sample dimensions are the given multiple of some aspect ratio
+func isMultipleSize(size image.Point, multiple int) bool {
+	if multiple == 0 {
+		return size.X == 1 && size.Y == 1
+	}
+	return size.X%multiple == 0 && size.Y%multiple == 0 && util.AspectRatio(image.Rectangle{Max: size}).Mul(multiple) == size
 }
 
-// BuildInMemoryIndex builds an in memory index of the image samples at the given multiple of the aspect ratio. 0 is special in that it is a 1x1.
-// fuzziness is how many of the top-N best matching tiles to randomly choose from for final selection
-func BuildInMemoryIndex(storage storage.Storage, multiple int, fuzziness int) (Index, error) {
-	defer util.LogTime("build index")()
-	keys, err := storage.Keys()
+// NewInMemoryIndex reads the lab samples at options.Multiple out of the bolt index for source once,
+// and serves all searches from memory. The options have the same meaning as for NewBoltIndex.
+func NewInMemoryIndex(source string, options Options) (Index, error) {
+	defer util.LogTime("load index")()
+	db, metadata, err := openSearchDB(source, options.Multiple)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	encoding, err := getEncoding(metadata.Encoding)
 	if err != nil {
 		return nil, err
 	}
+
 	index := &inMemoryIndex{
-		keyToID:   make(map[string]int),
-		idToKey:   keys,
-		multiple:  multiple,
-		fuzziness: fuzziness,
-		samples:   make(map[image.Point]map[int]sample),
+		names:     make(map[int]string),
+		options:   options,
+		searchers: make(map[image.Point]searcher),
 	}
-	for id, key := range keys {
-		index.keyToID[key] = id
-		data, err := storage.Load(key)
-		if err != nil {
-			return nil, err
-		}
-		if index.samples[data.AspectRatio] == nil {
-			index.samples[data.AspectRatio] = make(map[int]sample)
+	if err := db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return fmt.Errorf("root bucket not found")
 		}
-		rotatedAspectRatio := image.Point{X: data.AspectRatio.Y, Y: data.AspectRatio.X}
-		if index.samples[rotatedAspectRatio] == nil {
-			index.samples[rotatedAspectRatio] = make(map[int]sample)
+		namesBucket := rootBucket.Bucket(namesKey)
+		if namesBucket == nil {
+			return fmt.Errorf("names bucket not found")
 		}
-		// The requested multiple is not available, error out
-		if len(data.Samples) < (multiple + 1) {
-			return nil, fmt.Errorf("requested multiple %d not available for %s", multiple, key)
+		if err := namesBucket.ForEach(func(k, v []byte) error {
+			index.names[bytesToInt(k)] = string(v)
+			return nil
+		}); err != nil {
+			return err
 		}
-		index.samples[data.AspectRatio][id] = toSample(data.Samples[multiple])
-
-		// Store the rotated image if it is not square
-		if !rotatedAspectRatio.Eq(data.AspectRatio) {
-			index.samples[rotatedAspectRatio][id] = toSample(imaging.Rotate90(data.Samples[multiple]))
+		dataBucket := rootBucket.Bucket(labDataKey)
+		if dataBucket == nil {
+			return fmt.Errorf("data bucket not found")
 		}
+		include := sourceAspectRatioFilter(rootBucket, options)
+		return dataBucket.ForEach(func(k, v []byte) error {
+			size := bytesToPoint(k)
+			if !isMultipleSize(size, options.Multiple) {
+				return nil
+			}
+			s, err := loadSearcher(dataBucket.Bucket(k), encoding, options.metric(), include)
+			if err != nil {
+				return err
+			}
+			index.searchers[size] = s
+			return nil
+		})
+	}); err != nil {
+		return nil, err
 	}
 	return index, nil
 }
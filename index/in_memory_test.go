@@ -0,0 +1,90 @@
+package index
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// randomImage is a w by h image of random opaque pixels
+func randomImage(r *rand.Rand, w, h int) *image.NRGBA {
+	img := imaging.New(w, h, color.NRGBA{})
+	r.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+func TestInMemoryMatchesBolt(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "photos")
+	indexSolidImages(t, src, map[string]solidImage{
+		"red.jpg":   {color: color.NRGBA{R: 200, G: 20, B: 20, A: 255}},
+		"green.jpg": {color: color.NRGBA{R: 20, G: 200, B: 20, A: 255}},
+		"blue.jpg":  {color: color.NRGBA{R: 20, G: 20, B: 200, A: 255}, portrait: true},
+		"gray.jpg":  {color: color.NRGBA{R: 128, G: 128, B: 128, A: 255}},
+		"white.jpg": {color: color.NRGBA{R: 240, G: 240, B: 240, A: 255}, portrait: true},
+	})
+
+	r := rand.New(rand.NewSource(1))
+	queries := make([]*image.NRGBA, 20)
+	for i := range queries {
+		queries[i] = randomImage(r, 40, 30)
+	}
+	tests := []Options{
+		{Multiple: 0, Fuzziness: 1, Seed: 1},
+		{Multiple: 1, Fuzziness: 3, Seed: 1},
+		// More than the 5 images in the index
+		{Multiple: 1, Fuzziness: 10, Seed: 2},
+	}
+	for _, options := range tests {
+		// Each holds the index file open until it is done with it, so the in memory index goes first
+		inMemory, err := NewInMemoryIndex(src, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		onDisk, err := NewBoltIndex(src, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := options.Fuzziness
+		if found > 5 {
+			found = 5
+		}
+		for i, query := range queries {
+			expected, err := onDisk.SearchTopK(query, image.Point{X: 4, Y: 3}, options.Fuzziness)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := inMemory.SearchTopK(query, image.Point{X: 4, Y: 3}, options.Fuzziness)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expected) != len(actual) || len(actual) != found {
+				t.Fatalf("%+v query %d: in memory found %v, bolt found %v", options, i, actual, expected)
+			}
+			for j := range expected {
+				if expected[j] != actual[j] {
+					t.Fatalf("%+v query %d: in memory found %v, bolt found %v", options, i, actual, expected)
+				}
+			}
+
+			expectedName, err := onDisk.Search(query, image.Point{X: 4, Y: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			actualName, err := inMemory.Search(query, image.Point{X: 4, Y: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expectedName != actualName {
+				t.Fatalf("%+v query %d: in memory picked %s, bolt picked %s", options, i, actualName, expectedName)
+			}
+		}
+		onDisk.(*boltIndex).db.Close()
+	}
+}
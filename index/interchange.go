@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"time"
+
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The interchange format is line delimited JSON, see docs/index-format.md
+const (
+	interchangeFormat  = "mosaicer-index"
+	interchangeVersion = 1
+
+	// importBatchSize is the number of images Import writes in each transaction
+	importBatchSize = 1000
+)
+
+type interchangeHeader struct {
+	Format   string   `json:"format"`
+	Version  int      `json:"version"`
+	Metadata Metadata `json:"metadata"`
+}
+
+type interchangeImage struct {
+	Name        string     `json:"name"`
+	AspectRatio string     `json:"aspect_ratio,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	ModTime     *time.Time `json:"mod_time,omitempty"`
+	// L*a*b* samples by dimensions, like "4x3". Each is a list of L*, a*, b* triples in row major order.
+	Samples map[string][]float64 `json:"samples"`
+}
+
+func formatDimensions(size image.Point) string {
+	return fmt.Sprintf("%dx%d", size.X, size.Y)
+}
+
+func parseDimensions(dimensions string) (image.Point, error) {
+	var size image.Point
+	if _, err := fmt.Sscanf(dimensions, "%dx%d", &size.X, &size.Y); err != nil {
+		return image.Point{}, fmt.Errorf("invalid dimensions %q: %v", dimensions, err)
+	}
+	return size, nil
+}
+
+// scaleLab converts between the go-colorful L*a*b* scale used internally and the usual 0-100 L* scale
+func scaleLab(lab []float64, scale float64) []float64 {
+	scaled := make([]float64, len(lab))
+	for i, f := range lab {
+		scaled[i] = f * scale
+	}
+	return scaled
+}
+
+// Export writes the index for source to w in the interchange format
+func Export(source string, w io.Writer) (int, error) {
+	if _, err := os.Stat(source + Suffix); os.IsNotExist(err) {
+		return 0, fmt.Errorf("no index found for %s", source)
+	}
+	db, err := boltDB(source)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	exported := 0
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	if err := db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return fmt.Errorf("index for %s is empty", source)
+		}
+		metadata, err := readMetadata(rootBucket)
+		if err != nil {
+			return err
+		}
+		encoding, err := getEncoding(metadata.Encoding)
+		if err != nil {
+			return err
+		}
+		// The RGBA samples aren't exported
+		metadata.RGBA = false
+		if err := encoder.Encode(interchangeHeader{Format: interchangeFormat, Version: interchangeVersion, Metadata: *metadata}); err != nil {
+			return err
+		}
+
+		namesBucket := rootBucket.Bucket(namesKey)
+		labDataBucket := rootBucket.Bucket(labDataKey)
+		if namesBucket == nil || labDataBucket == nil {
+			return nil
+		}
+		infoBucket := rootBucket.Bucket(infoKey)
+		aspectRatiosBucket := rootBucket.Bucket(aspectRatiosKey)
+		return namesBucket.ForEach(func(k, v []byte) error {
+			record := interchangeImage{
+				Name:    string(v),
+				Samples: make(map[string][]float64),
+			}
+			if infoBucket != nil {
+				if info := infoBucket.Get(k); info != nil {
+					imageInfo := bytesToInfo(info)
+					record.Size = imageInfo.Size
+					record.ModTime = &imageInfo.ModTime
+				}
+			}
+			if aspectRatiosBucket != nil {
+				if aspectRatio := aspectRatiosBucket.Get(k); aspectRatio != nil {
+					record.AspectRatio = formatAspectRatio(bytesToPoint(aspectRatio))
+				}
+			}
+			if err := labDataBucket.ForEach(func(dimensions, _ []byte) error {
+				if sample := labDataBucket.Bucket(dimensions).Get(k); sample != nil {
+					record.Samples[formatDimensions(bytesToPoint(dimensions))] = scaleLab(encoding.decode(sample), labScale)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			exported++
+			return encoder.Encode(record)
+		})
+	}); err != nil {
+		return exported, err
+	}
+	return exported, buffered.Flush()
+}
+
+// Import reads images in the interchange format from r into the index for target, which is
+// created if it doesn't exist. rename is applied to every name before it is stored. encoding
+// overrides the encoding of the samples if it is not empty.
+func Import(target string, r io.Reader, rename func(string) string, encoding string) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	var header interchangeHeader
+	if err := decoder.Decode(&header); err != nil {
+		return 0, fmt.Errorf("invalid header: %v", err)
+	}
+	if header.Format != interchangeFormat {
+		return 0, fmt.Errorf("not a mosaicer index export, format is %q", header.Format)
+	}
+	if header.Version != interchangeVersion {
+		return 0, fmt.Errorf("unsupported export version %d", header.Version)
+	}
+	metadata := header.Metadata
+	metadata.RGBA = false
+	if encoding != "" {
+		metadata.Encoding = encoding
+	}
+	existing, err := ReadMetadata(target)
+	if err != nil {
+		return 0, err
+	}
+	if existing != nil {
+		if err := existing.Compatible(metadata); err != nil {
+			return 0, fmt.Errorf("can't import into the existing index: %v", err)
+		}
+	}
+	builder, err := newBoltIndexBuilder(target, metadata)
+	if err != nil {
+		return 0, err
+	}
+	defer builder.Close()
+
+	imported := 0
+	pending := make([]indexedImage, 0, importBatchSize)
+	for {
+		var record interchangeImage
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return imported, fmt.Errorf("invalid image after %d images: %v", imported+len(pending), err)
+		}
+		data := &analysis.ImageData{
+			Samples:    make([]*image.NRGBA, 0),
+			LabSamples: make(map[image.Point][]float64),
+		}
+		for dimensions, sample := range record.Samples {
+			size, err := parseDimensions(dimensions)
+			if err != nil {
+				return imported, err
+			}
+			if len(sample) != size.X*size.Y*3 {
+				return imported, fmt.Errorf("%s: sample %s has %d values, expected %d", record.Name, dimensions, len(sample), size.X*size.Y*3)
+			}
+			data.LabSamples[size] = scaleLab(sample, 1/labScale)
+		}
+		if record.AspectRatio != "" {
+			var aspectRatio image.Point
+			if _, err := fmt.Sscanf(record.AspectRatio, "%d:%d", &aspectRatio.X, &aspectRatio.Y); err != nil {
+				return imported, fmt.Errorf("%s: invalid aspect ratio %q", record.Name, record.AspectRatio)
+			}
+			data.SourceAspectRatio = aspectRatio
+		}
+		info := source.ImageInfo{Size: record.Size}
+		if record.ModTime != nil {
+			info.ModTime = *record.ModTime
+		}
+		pending = append(pending, indexedImage{name: rename(record.Name), info: info, data: data})
+		if len(pending) == importBatchSize {
+			if err := builder.indexAll(pending); err != nil {
+				return imported, err
+			}
+			imported += len(pending)
+			pending = pending[:0]
+		}
+	}
+	if err := builder.indexAll(pending); err != nil {
+		return imported, err
+	}
+	return imported + len(pending), nil
+}
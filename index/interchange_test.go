@@ -0,0 +1,233 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
+	bolt "go.etcd.io/bbolt"
+)
+
+// randomImageData has random 1x1 and 4x3 samples, as analysis would produce for a 4:3 crop
+func randomImageData(r *rand.Rand) *analysis.ImageData {
+	data := &analysis.ImageData{
+		AspectRatio:       image.Point{X: 4, Y: 3},
+		SourceAspectRatio: image.Point{X: 3, Y: 2},
+		LabSamples:        make(map[image.Point][]float64),
+	}
+	for _, size := range []image.Point{{X: 1, Y: 1}, {X: 4, Y: 3}} {
+		pix := make([]uint8, 4*size.X*size.Y)
+		r.Read(pix)
+		data.LabSamples[size] = analysis.RGBAToLab(pix)
+	}
+	return data
+}
+
+// readSamples decodes every lab_data sample of the index for src by name and dimensions
+func readSamples(t *testing.T, src string) map[string]map[image.Point][]float64 {
+	db, err := boltDB(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	samples := make(map[string]map[image.Point][]float64)
+	if err := db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		metadata, err := readMetadata(rootBucket)
+		if err != nil {
+			return err
+		}
+		encoding, err := getEncoding(metadata.Encoding)
+		if err != nil {
+			return err
+		}
+		labDataBucket := rootBucket.Bucket(labDataKey)
+		return labDataBucket.ForEach(func(dimensions, _ []byte) error {
+			return labDataBucket.Bucket(dimensions).ForEach(func(k, v []byte) error {
+				name, err := getName(bytesToInt(k), rootBucket)
+				if err != nil {
+					return err
+				}
+				if samples[name] == nil {
+					samples[name] = make(map[image.Point][]float64)
+				}
+				samples[name][bytesToPoint(dimensions)] = encoding.decode(v)
+				return nil
+			})
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+// exportTestIndex indexes random images under names into a new index, and exports it
+func exportTestIndex(t *testing.T, r *rand.Rand, names ...string) (string, []byte) {
+	src := filepath.Join(t.TempDir(), "photos")
+	builder, err := NewBoltIndexBuilder(src, Metadata{
+		Samples:         2,
+		CropAspectRatio: image.Point{X: 4, Y: 3},
+		Analyzer:        analysis.SimpleAnalyzer,
+		ColorSpace:      analysis.LabColorSpace,
+		Encoding:        Float64Encoding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		info := source.ImageInfo{Size: int64(1000 + i), ModTime: time.Unix(1600000000, int64(i))}
+		if err := builder.Index(name, info, randomImageData(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builder.Close()
+
+	var exported bytes.Buffer
+	n, err := Export(src, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(names) {
+		t.Fatalf("Exported %d images, expected %d", n, len(names))
+	}
+	return src, exported.Bytes()
+}
+
+func TestExportScale(t *testing.T) {
+	src, exported := exportTestIndex(t, rand.New(rand.NewSource(1)), "a.jpg")
+	expected := readSamples(t, src)["a.jpg"][image.Point{X: 1, Y: 1}]
+
+	// The first line is the header, the second the image
+	scanner := bufio.NewScanner(bytes.NewReader(exported))
+	scanner.Scan()
+	scanner.Scan()
+	var record interchangeImage
+	if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	sample := record.Samples["1x1"]
+	if len(sample) != 3 {
+		t.Fatalf("Expected a 1x1 sample with 3 values, got %v", sample)
+	}
+	for i := range sample {
+		if math.Abs(sample[i]-expected[i]*100) > 1e-9 {
+			t.Fatalf("Exported %v, expected %v on the 0-100 L* scale", sample, expected)
+		}
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	names := []string{"a.jpg", "b.jpg", "dir/c.jpg"}
+	src, exported := exportTestIndex(t, rand.New(rand.NewSource(2)), names...)
+	expected := readSamples(t, src)
+
+	// Maximum error per component for each encoding, after converting to the export scale and back
+	tolerances := map[string]float64{
+		Float64Encoding: 1e-12,
+		Float32Encoding: 1e-6,
+		Uint8Encoding:   0.5 / labScale,
+	}
+	for encoding, tolerance := range tolerances {
+		target := filepath.Join(t.TempDir(), "imported")
+		imported, err := Import(target, bytes.NewReader(exported), func(name string) string { return "copy/" + name }, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported != len(names) {
+			t.Fatalf("%s: imported %d images, expected %d", encoding, imported, len(names))
+		}
+		metadata, err := ReadMetadata(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.Encoding != encoding || metadata.Samples != 2 {
+			t.Fatalf("%s: imported index has metadata %+v", encoding, metadata)
+		}
+
+		actual := readSamples(t, target)
+		for name, samples := range expected {
+			for size, sample := range samples {
+				decoded := actual["copy/"+name][size]
+				if len(decoded) != len(sample) {
+					t.Fatalf("%s: %s %v has %d components, expected %d", encoding, name, size, len(decoded), len(sample))
+				}
+				for i := range sample {
+					if math.Abs(decoded[i]-sample[i]) > tolerance {
+						t.Fatalf("%s: %s %v component %d imported as %v, expected %v", encoding, name, size, i, decoded[i], sample[i])
+					}
+				}
+			}
+		}
+
+		// The info is kept, so re-indexing the source doesn't analyze the images again
+		builder, err := NewBoltIndexBuilder(target, *metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, err := builder.IsCurrent("copy/b.jpg", source.ImageInfo{Size: 1001, ModTime: time.Unix(1600000000, 1)})
+		builder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !current {
+			t.Fatalf("%s: imported image info doesn't match the export", encoding)
+		}
+	}
+}
+
+// numberedExport is an export of images named 0.jpg, 1.jpg, ... with a 1x1 sample each
+func numberedExport(t *testing.T, images int) *bytes.Buffer {
+	var exported bytes.Buffer
+	encoder := json.NewEncoder(&exported)
+	if err := encoder.Encode(interchangeHeader{Format: interchangeFormat, Version: interchangeVersion, Metadata: Metadata{
+		Samples:         1,
+		CropAspectRatio: image.Point{X: 4, Y: 3},
+		Analyzer:        analysis.SimpleAnalyzer,
+		ColorSpace:      analysis.LabColorSpace,
+		Encoding:        Float32Encoding,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < images; i++ {
+		record := interchangeImage{
+			Name:    fmt.Sprintf("%d.jpg", i),
+			Samples: map[string][]float64{"1x1": {float64(i % 100), 0, 0}},
+		}
+		if err := encoder.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &exported
+}
+
+func TestImportTime(t *testing.T) {
+	const images = 3000
+	exported := numberedExport(t, images)
+
+	// Writing each image in its own batch would wait 10ms for each, so 30s in all
+	start := time.Now()
+	target := filepath.Join(t.TempDir(), "imported")
+	imported, err := Import(target, exported, func(name string) string { return name }, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Importing %d images took %v", images, elapsed)
+	}
+	if imported != images {
+		t.Fatalf("Imported %d images, expected %d", imported, images)
+	}
+	samples := readSamples(t, target)
+	if len(samples) != images || samples["2999.jpg"] == nil {
+		t.Fatalf("Expected %d images in the index, found %d", images, len(samples))
+	}
+}
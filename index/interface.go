@@ -18,19 +18,65 @@ import (
 	"image"
 
 	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
 )
 
 // Builder is an interface for building an index
 type Builder interface {
-	// Write the given image data into the index
-	Index(name string, data *analysis.ImageData) error
+	// Write the given image data into the index, replacing any existing data for the name
+	Index(name string, info source.ImageInfo, data *analysis.ImageData) error
+
+	// Whether the index already has data for the name from an image matching info
+	IsCurrent(name string, info source.ImageInfo) (bool, error)
+
+	// Remove every image that is not in names from the index. Returns the number of images removed.
+	Prune(names []string) (int, error)
 
 	// Finish creating the index
 	Close() error
 }
 
+// Options configure searching an index
+type Options struct {
+	// Multiple of the aspect ratio of the samples to search against. 0 searches the 1x1 samples.
+	Multiple int
+	// Number of top matches Search picks from at random
+	Fuzziness int
+	// Seed for Search's random picks, which makes the pick for a given image always the same. 0
+	// picks differently every time.
+	Seed int64
+	// Allow matches within a factor of (1 + Approximation) of the best distances. 0 is an exact search.
+	Approximation float64
+	// Whether to also match the mirrored and upside down versions of the images
+	Augment bool
+	// Metric to compare samples with, defaults to CIE76
+	Metric Metric
+	// If set, only images whose aspect ratio before cropping passes are searched
+	SourceAspectRatio func(aspectRatio image.Point) bool
+}
+
+func (o Options) metric() Metric {
+	if o.Metric.Distance == nil {
+		return CIE76
+	}
+	return o.Metric
+}
+
+// Candidate is a matching image returned from a search
+type Candidate struct {
+	Name string
+	// Distance between the candidate and the searched image
+	Distance float64
+	// Transform to apply to the candidate image for it to match the searched image
+	Transform Transform
+}
+
 // Index is an interface for wrapping up an image index for finding matching images
 type Index interface {
 	// Find the best matching image for the given source image
 	Search(img *image.NRGBA, aspectRatio image.Point) (string, error)
+
+	// Find the k best matching images for the given source image, ordered from best to worst.
+	// Transparent pixels of the source image are ignored.
+	SearchTopK(img *image.NRGBA, aspectRatio image.Point, k int) ([]Candidate, error)
 }
@@ -0,0 +1,250 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// the metadata lives in its own bucket under the root:
+// v1
+// - meta
+//   - string key -> string value
+var (
+	metaKey = []byte("meta")
+
+	samplesMetaKey         = []byte("samples")
+	cropAspectRatioMetaKey = []byte("crop_aspect_ratio")
+	analyzerMetaKey        = []byte("analyzer")
+	colorSpaceMetaKey      = []byte("color_space")
+	encodingMetaKey        = []byte("encoding")
+	rgbaMetaKey            = []byte("rgba")
+	subCropsMetaKey        = []byte("sub_crops")
+	subCropScaleMetaKey    = []byte("sub_crop_scale")
+
+	// legacyCropAspectRatio is what every index was cropped to before it was recorded
+	legacyCropAspectRatio = image.Point{X: 4, Y: 3}
+)
+
+// Metadata describes how an index was built
+type Metadata struct {
+	// Number of samples taken of each image, at multiples 0 through Samples-1 of the aspect ratio
+	Samples int `json:"samples"`
+	// Aspect ratio the images were cropped to before being analyzed
+	CropAspectRatio image.Point `json:"crop_aspect_ratio"`
+	// Name of the analysis that generated the samples
+	Analyzer string `json:"analyzer"`
+	// Color space of the lab_data samples
+	ColorSpace string `json:"color_space"`
+	// Encoding of the lab_data samples, one of EncodingNames
+	Encoding string `json:"encoding"`
+	// Whether the RGBA samples are stored in the data bucket
+	RGBA bool `json:"rgba"`
+	// Each image is also indexed as a SubCrops by SubCrops grid of sub-crops, each SubCropScale
+	// percent of the size of the image
+	SubCrops     int `json:"sub_crops,omitempty"`
+	SubCropScale int `json:"sub_crop_scale,omitempty"`
+}
+
+// Compatible returns an error describing the first difference that would make data
+// built with other unusable alongside data built with m
+func (m Metadata) Compatible(other Metadata) error {
+	if m.Samples != other.Samples {
+		return fmt.Errorf("index was built with --samples %d, not %d", m.Samples, other.Samples)
+	}
+	if m.CropAspectRatio != other.CropAspectRatio {
+		return fmt.Errorf("index was built with images cropped to %d:%d, not %d:%d",
+			m.CropAspectRatio.X, m.CropAspectRatio.Y, other.CropAspectRatio.X, other.CropAspectRatio.Y)
+	}
+	if m.Analyzer != other.Analyzer {
+		return fmt.Errorf("index was built with the %q analyzer, not %q", m.Analyzer, other.Analyzer)
+	}
+	if m.ColorSpace != other.ColorSpace {
+		return fmt.Errorf("index was built in the %q color space, not %q", m.ColorSpace, other.ColorSpace)
+	}
+	if m.Encoding != other.Encoding {
+		return fmt.Errorf("index samples are encoded as %s, not %s. Use mosaicer index migrate to change the encoding", m.Encoding, other.Encoding)
+	}
+	if m.RGBA != other.RGBA {
+		return fmt.Errorf("index was built with --rgba=%t, not %t", m.RGBA, other.RGBA)
+	}
+	return nil
+}
+
+// CheckMultiple returns an actionable error if samples at the given multiple are not in the index
+func (m Metadata) CheckMultiple(multiple int) error {
+	if multiple < 0 || multiple >= m.Samples {
+		return fmt.Errorf("index was built with --samples %d, so --referencePatchMultiple must be between 0 and %d. "+
+			"Re-run mosaicer index with --samples %d --force to use --referencePatchMultiple %d",
+			m.Samples, m.Samples-1, multiple+1, multiple)
+	}
+	return nil
+}
+
+func writeMetadata(metadata Metadata, rootBucket *bolt.Bucket) error {
+	metaBucket, err := rootBucket.CreateBucketIfNotExists(metaKey)
+	if err != nil {
+		return err
+	}
+	values := map[string][]byte{
+		string(samplesMetaKey):         []byte(strconv.Itoa(metadata.Samples)),
+		string(cropAspectRatioMetaKey): []byte(fmt.Sprintf("%d:%d", metadata.CropAspectRatio.X, metadata.CropAspectRatio.Y)),
+		string(analyzerMetaKey):        []byte(metadata.Analyzer),
+		string(colorSpaceMetaKey):      []byte(metadata.ColorSpace),
+		string(encodingMetaKey):        []byte(metadata.Encoding),
+		string(rgbaMetaKey):            []byte(strconv.FormatBool(metadata.RGBA)),
+		string(subCropsMetaKey):        []byte(strconv.Itoa(metadata.SubCrops)),
+		string(subCropScaleMetaKey):    []byte(strconv.Itoa(metadata.SubCropScale)),
+	}
+	for k, v := range values {
+		if err := metaBucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inferMetadata works out the metadata of indexes built before it was recorded
+func inferMetadata(rootBucket *bolt.Bucket) (*Metadata, error) {
+	labDataBucket := rootBucket.Bucket(labDataKey)
+	if labDataBucket == nil {
+		return nil, nil
+	}
+	metadata := &Metadata{
+		CropAspectRatio: legacyCropAspectRatio,
+		Analyzer:        analysis.SimpleAnalyzer,
+		ColorSpace:      analysis.LabColorSpace,
+		Encoding:        Float64Encoding,
+		RGBA:            rootBucket.Bucket(dataKey) != nil,
+	}
+	if err := labDataBucket.ForEach(func(k, v []byte) error {
+		size := bytesToPoint(k)
+		multiple := size.X / util.AspectRatio(image.Rectangle{Max: size}).X
+		// The 1x1 sample is always multiple 0
+		if size.X == 1 && size.Y == 1 {
+			multiple = 0
+		}
+		if multiple+1 > metadata.Samples {
+			metadata.Samples = multiple + 1
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func readMetadata(rootBucket *bolt.Bucket) (*Metadata, error) {
+	metaBucket := rootBucket.Bucket(metaKey)
+	if metaBucket == nil {
+		return inferMetadata(rootBucket)
+	}
+	samples, err := strconv.Atoi(string(metaBucket.Get(samplesMetaKey)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid samples in index metadata: %v", err)
+	}
+	cropAspectRatio, err := util.ParseAspectRatioString(string(metaBucket.Get(cropAspectRatioMetaKey)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid crop aspect ratio in index metadata: %v", err)
+	}
+	metadata := &Metadata{
+		Samples:         samples,
+		CropAspectRatio: cropAspectRatio,
+		Analyzer:        string(metaBucket.Get(analyzerMetaKey)),
+		ColorSpace:      string(metaBucket.Get(colorSpaceMetaKey)),
+		Encoding:        string(metaBucket.Get(encodingMetaKey)),
+		// Metadata written before these were recorded always used the original layout
+		RGBA: true,
+	}
+	if metadata.Encoding == "" {
+		metadata.Encoding = Float64Encoding
+	}
+	if rgba := metaBucket.Get(rgbaMetaKey); rgba != nil {
+		if metadata.RGBA, err = strconv.ParseBool(string(rgba)); err != nil {
+			return nil, fmt.Errorf("invalid rgba in index metadata: %v", err)
+		}
+	}
+	// Indexes without sub-crops may not have recorded them
+	if subCrops := metaBucket.Get(subCropsMetaKey); subCrops != nil {
+		if metadata.SubCrops, err = strconv.Atoi(string(subCrops)); err != nil {
+			return nil, fmt.Errorf("invalid sub crops in index metadata: %v", err)
+		}
+	}
+	if subCropScale := metaBucket.Get(subCropScaleMetaKey); subCropScale != nil {
+		if metadata.SubCropScale, err = strconv.Atoi(string(subCropScale)); err != nil {
+			return nil, fmt.Errorf("invalid sub crop scale in index metadata: %v", err)
+		}
+	}
+	return metadata, nil
+}
+
+func dbMetadata(db *bolt.DB) (*Metadata, error) {
+	var metadata *Metadata
+	if err := db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return nil
+		}
+		var err error
+		metadata, err = readMetadata(rootBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// ReadMetadata reads the metadata of the index for source. Returns nil if there is no index yet.
+func ReadMetadata(source string) (*Metadata, error) {
+	if _, err := os.Stat(source + Suffix); os.IsNotExist(err) {
+		return nil, nil
+	}
+	db, err := boltDB(source)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return dbMetadata(db)
+}
+
+// openSearchDB opens the index for source for searching, and checks that it has samples at the given multiple
+func openSearchDB(source string, multiple int) (*bolt.DB, *Metadata, error) {
+	if _, err := os.Stat(source + Suffix); os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("no index found for %s. Run mosaicer index %s first", source, source)
+	}
+	db, err := boltDB(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata, err := dbMetadata(db)
+	if err == nil && metadata == nil {
+		err = fmt.Errorf("index for %s is empty. Run mosaicer index %s first", source, source)
+	}
+	if err == nil {
+		err = metadata.CheckMultiple(multiple)
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, metadata, nil
+}
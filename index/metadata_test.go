@@ -0,0 +1,108 @@
+package index
+
+import (
+	"image"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		change   func(m *Metadata)
+		expected string
+	}{
+		{func(m *Metadata) {}, ""},
+		{func(m *Metadata) { m.Samples = 3 }, "--samples 1, not 3"},
+		{func(m *Metadata) { m.CropAspectRatio = image.Point{X: 3, Y: 2} }, "cropped to 4:3, not 3:2"},
+		{func(m *Metadata) { m.Encoding = Uint8Encoding }, "encoded as float64, not uint8"},
+		{func(m *Metadata) { m.RGBA = true }, "--rgba=false, not true"},
+		// Sub-crops are separate images, so they don't change how the samples are stored
+		{func(m *Metadata) { m.SubCrops, m.SubCropScale = 2, 50 }, ""},
+	}
+	for _, test := range tests {
+		other := testMetadata
+		test.change(&other)
+		err := testMetadata.Compatible(other)
+		if test.expected == "" && err != nil {
+			t.Fatalf("Expected %+v to be compatible, got %v", other, err)
+		}
+		if test.expected != "" && (err == nil || !strings.Contains(err.Error(), test.expected)) {
+			t.Fatalf("Expected %+v to be incompatible with %q, got %v", other, test.expected, err)
+		}
+	}
+}
+
+func TestCheckMultiple(t *testing.T) {
+	metadata := testMetadata
+	metadata.Samples = 2
+	for multiple, ok := range map[int]bool{-1: false, 0: true, 1: true, 2: false} {
+		if err := metadata.CheckMultiple(multiple); (err == nil) != ok {
+			t.Fatalf("CheckMultiple(%d) with --samples 2 returned %v", multiple, err)
+		}
+	}
+
+	src := indexTestImages(t, "a.jpg")
+	if _, err := NewBoltIndex(src, Options{Multiple: 1}); err == nil || !strings.Contains(err.Error(), "--samples 2 --force") {
+		t.Fatalf("Expected searching multiple 1 of an index with --samples 1 to fail, got %v", err)
+	}
+	if _, err := NewInMemoryIndex(filepath.Join(t.TempDir(), "missing"), Options{}); err == nil || !strings.Contains(err.Error(), "no index found") {
+		t.Fatalf("Expected searching a missing index to fail, got %v", err)
+	}
+}
+
+func TestLegacyMetadata(t *testing.T) {
+	for _, rgba := range []bool{false, true} {
+		src := filepath.Join(t.TempDir(), "photos")
+		metadata := Metadata{
+			Samples:         3,
+			CropAspectRatio: image.Point{X: 4, Y: 3},
+			Analyzer:        analysis.SimpleAnalyzer,
+			ColorSpace:      analysis.LabColorSpace,
+			Encoding:        Float64Encoding,
+			RGBA:            rgba,
+		}
+		builder, err := NewBoltIndexBuilder(src, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := &analysis.ImageData{AspectRatio: image.Point{X: 4, Y: 3}, LabSamples: make(map[image.Point][]float64)}
+		for _, size := range []image.Point{{X: 1, Y: 1}, {X: 4, Y: 3}, {X: 8, Y: 6}} {
+			data.LabSamples[size] = make([]float64, 3*size.X*size.Y)
+			data.Samples = append(data.Samples, image.NewNRGBA(image.Rectangle{Max: size}))
+		}
+		if err := builder.Index("a.jpg", source.ImageInfo{}, data); err != nil {
+			t.Fatal(err)
+		}
+		builder.Close()
+
+		// Indexes from before the metadata was recorded have no meta bucket
+		db, err := boltDB(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(rootKey).DeleteBucket(metaKey)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		inferred, err := ReadMetadata(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inferred == nil || *inferred != metadata {
+			t.Fatalf("Inferred %+v, expected %+v", inferred, metadata)
+		}
+	}
+
+	// A new index has no metadata to infer
+	if metadata, err := ReadMetadata(filepath.Join(t.TempDir(), "missing")); metadata != nil || err != nil {
+		t.Fatalf("Expected no metadata for a missing index, got %+v, %v", metadata, err)
+	}
+}
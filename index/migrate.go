@@ -0,0 +1,125 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"fmt"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxSize is how many bytes are copied per transaction when compacting
+const compactTxSize = 1 << 20
+
+// Migrate rewrites the index for source to use the given lab sample encoding, dropping the RGBA
+// samples if rgba is false. The file is compacted afterwards so the freed space is returned.
+func Migrate(source string, encoding string, rgba bool) error {
+	newEncoding, err := getEncoding(encoding)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(source + Suffix); os.IsNotExist(err) {
+		return fmt.Errorf("no index found for %s", source)
+	}
+	db, err := boltDB(source)
+	if err != nil {
+		return err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := migrateIDs(tx); err != nil {
+			return err
+		}
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return fmt.Errorf("index for %s is empty", source)
+		}
+		metadata, err := readMetadata(rootBucket)
+		if err != nil {
+			return err
+		}
+		if rgba && !metadata.RGBA {
+			return fmt.Errorf("the RGBA samples have already been dropped, re-index with --force to restore them")
+		}
+		oldEncoding, err := getEncoding(metadata.Encoding)
+		if err != nil {
+			return err
+		}
+		if metadata.Encoding != encoding {
+			if err := reencode(rootBucket.Bucket(labDataKey), oldEncoding, newEncoding); err != nil {
+				return err
+			}
+		}
+		if !rgba && rootBucket.Bucket(dataKey) != nil {
+			if err := rootBucket.DeleteBucket(dataKey); err != nil {
+				return err
+			}
+		}
+		metadata.Encoding = encoding
+		metadata.RGBA = rgba
+		return writeMetadata(*metadata, rootBucket)
+	}); err != nil {
+		db.Close()
+		return err
+	}
+	return compact(source, db)
+}
+
+// reencode converts every sample in the dimension buckets of labDataBucket between encodings
+func reencode(labDataBucket *bolt.Bucket, from, to labEncoding) error {
+	if labDataBucket == nil {
+		return nil
+	}
+	return labDataBucket.ForEach(func(k, v []byte) error {
+		dimensionBucket := labDataBucket.Bucket(k)
+		if dimensionBucket == nil {
+			return nil
+		}
+		// Buckets can't be modified while iterating over them, so collect the new values first
+		encoded := make(map[string][]byte)
+		if err := dimensionBucket.ForEach(func(id, sample []byte) error {
+			encoded[string(id)] = to.encode(from.decode(sample))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for id, sample := range encoded {
+			if err := dimensionBucket.Put([]byte(id), sample); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// compact copies db into a fresh file and replaces the index for source with it. db is closed.
+func compact(source string, db *bolt.DB) error {
+	tmpPath := source + Suffix + ".tmp"
+	dst, err := bolt.Open(tmpPath, 0666, nil)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	err = bolt.Compact(dst, db, compactTxSize)
+	db.Close()
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, source+Suffix)
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/timwu/mosaicer/source"
+	bolt "go.etcd.io/bbolt"
+)
+
+type multiIndex struct {
+	namespaces []string
+	indexes    []Index
+	fuzziness  int
+	seed       int64
+}
+
+func (m *multiIndex) Search(img *image.NRGBA, aspectRatio image.Point) (string, error) {
+	return searchFuzzy(m, img, aspectRatio, m.fuzziness, m.seed)
+}
+
+func (m *multiIndex) SearchTopK(img *image.NRGBA, aspectRatio image.Point, k int) ([]Candidate, error) {
+	candidates := make([]Candidate, 0)
+	for i, index := range m.indexes {
+		indexCandidates, err := index.SearchTopK(img, aspectRatio, k)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range indexCandidates {
+			candidate.Name = source.JoinNamespace(m.namespaces[i], candidate.Name)
+			candidates = append(candidates, candidate)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Distance < candidates[j].Distance
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates, nil
+}
+
+// NewMultiIndex searches several indexes as one. The names of candidates from indexes[i] are
+// namespaced with namespaces[i] using source.JoinNamespace, matching source.NewCompositeSource.
+// Search uses the Fuzziness and Seed of the options.
+func NewMultiIndex(namespaces []string, indexes []Index, options Options) (Index, error) {
+	if len(namespaces) != len(indexes) {
+		return nil, fmt.Errorf("got %d namespaces for %d indexes", len(namespaces), len(indexes))
+	}
+	return &multiIndex{
+		namespaces: namespaces,
+		indexes:    indexes,
+		fuzziness:  options.Fuzziness,
+		seed:       options.Seed,
+	}, nil
+}
+
+// Merge combines the indexes of several sources into the index for target, all with images cropped
+// to cropAspectRatio. Names are namespaced by their source, cleaned with filepath.Clean, using
+// source.JoinNamespace, so the merged index can be used with a source.NewCompositeSource of the
+// same sources. The samples are stored in the encoding of the first index, and the RGBA samples
+// are dropped.
+func Merge(target string, sources []string, cropAspectRatio image.Point) (int, error) {
+	if len(sources) == 0 {
+		return 0, fmt.Errorf("nothing to merge")
+	}
+	first, err := ReadMetadata(Name(sources[0], cropAspectRatio))
+	if err != nil {
+		return 0, err
+	}
+	if first == nil {
+		return 0, fmt.Errorf("no index found for %s", sources[0])
+	}
+	for _, src := range sources[1:] {
+		metadata, err := ReadMetadata(Name(src, cropAspectRatio))
+		if err != nil {
+			return 0, err
+		}
+		if metadata == nil {
+			return 0, fmt.Errorf("no index found for %s", src)
+		}
+		// The encoding is converted and RGBA samples dropped, so only the rest needs to match
+		metadata.Encoding = first.Encoding
+		metadata.RGBA = first.RGBA
+		if err := first.Compatible(*metadata); err != nil {
+			return 0, fmt.Errorf("can't merge %s with %s: %v", src, sources[0], err)
+		}
+	}
+
+	merged := 0
+	for _, src := range sources {
+		src, namespace := src, filepath.Clean(src)
+		r, w := io.Pipe()
+		go func() {
+			_, err := Export(Name(src, cropAspectRatio), w)
+			w.CloseWithError(err)
+		}()
+		imported, err := Import(Name(target, cropAspectRatio), r, func(name string) string {
+			return source.JoinNamespace(namespace, name)
+		}, first.Encoding)
+		r.Close()
+		merged += imported
+		if err != nil {
+			return merged, fmt.Errorf("merging %s: %v", src, err)
+		}
+	}
+	return merged, nil
+}
+
+// Namespaces lists the namespaces of the names in the index for src, which are the sources it was
+// merged from. Names without a namespace are ignored.
+func Namespaces(src string) ([]string, error) {
+	if _, err := os.Stat(src + Suffix); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no index found for %s", src)
+	}
+	db, err := boltDB(src)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	found := make(map[string]bool)
+	if err := db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil || rootBucket.Bucket(namesKey) == nil {
+			return nil
+		}
+		return rootBucket.Bucket(namesKey).ForEach(func(k, v []byte) error {
+			if namespace, _, err := source.SplitNamespace(string(v)); err == nil {
+				found[namespace] = true
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, 0, len(found))
+	for namespace := range found {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
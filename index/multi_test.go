@@ -0,0 +1,136 @@
+package index
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
+)
+
+// solidImage is a 4:3 image of a single color, or 3:4 if portrait
+type solidImage struct {
+	color    color.NRGBA
+	portrait bool
+}
+
+func (s solidImage) image() *image.NRGBA {
+	if s.portrait {
+		return imaging.New(30, 40, s.color)
+	}
+	return imaging.New(40, 30, s.color)
+}
+
+// indexSolidImages indexes each of the images into the index for src
+func indexSolidImages(t *testing.T, src string, images map[string]solidImage) {
+	builder, err := NewBoltIndexBuilder(src, Metadata{
+		Samples:         2,
+		CropAspectRatio: image.Point{X: 4, Y: 3},
+		Analyzer:        analysis.SimpleAnalyzer,
+		ColorSpace:      analysis.LabColorSpace,
+		Encoding:        Float32Encoding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+	for name, img := range images {
+		data, err := analysis.Simple(img.image(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := builder.Index(name, source.ImageInfo{Size: 1}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMergeImported(t *testing.T) {
+	dir := t.TempDir()
+	images := map[string]map[string]solidImage{
+		filepath.Join(dir, "a"): {
+			"red.jpg":  {color: color.NRGBA{R: 200, G: 20, B: 20, A: 255}},
+			"blue.jpg": {color: color.NRGBA{R: 20, G: 20, B: 200, A: 255}, portrait: true},
+		},
+		filepath.Join(dir, "b"): {
+			"green.jpg":     {color: color.NRGBA{R: 20, G: 200, B: 20, A: 255}},
+			"sub/white.jpg": {color: color.NRGBA{R: 240, G: 240, B: 240, A: 255}, portrait: true},
+		},
+	}
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+
+	// a is imported from an export of another index of the same images
+	original := filepath.Join(dir, "original")
+	indexSolidImages(t, original, images[a])
+	var exported bytes.Buffer
+	if _, err := Export(original, &exported); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(a, &exported, func(name string) string { return name }, ""); err != nil {
+		t.Fatal(err)
+	}
+	indexSolidImages(t, b, images[b])
+
+	// Namespaces are cleaned, so they don't depend on how the sources were written
+	merged := filepath.Join(dir, "merged")
+	n, err := Merge(merged, []string{a, dir + "/./b"}, image.Point{X: 4, Y: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("Merged %d images, expected 4", n)
+	}
+
+	namespaces, err := Namespaces(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(namespaces) != 2 || namespaces[0] != a || namespaces[1] != b {
+		t.Fatalf("Expected namespaces %s and %s, got %v", a, b, namespaces)
+	}
+
+	imgIndex, err := NewBoltIndex(merged, Options{Multiple: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for src, srcImages := range images {
+		for name, img := range srcImages {
+			candidates, err := imgIndex.SearchTopK(img.image(), image.Point{X: 4, Y: 3}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := source.JoinNamespace(src, name); len(candidates) != 1 || candidates[0].Name != expected {
+				t.Fatalf("Expected %s to match %s, got %v", name, expected, candidates)
+			}
+		}
+	}
+}
+
+func TestMergeTime(t *testing.T) {
+	const images = 1500
+	dir := t.TempDir()
+	sources := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, src := range sources {
+		if _, err := Import(src, numberedExport(t, images), func(name string) string { return name }, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Merging goes through Import, so it shouldn't wait out a write batch for each image either
+	start := time.Now()
+	n, err := Merge(filepath.Join(dir, "merged"), sources, image.Point{X: 4, Y: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Merging %d images took %v", n, elapsed)
+	}
+	if n != 2*images {
+		t.Fatalf("Merged %d images, expected %d", n, 2*images)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"math/rand"
+	"sort"
+
+	"github.com/disintegration/imaging"
+	"github.com/timwu/mosaicer/analysis"
+	bolt "go.etcd.io/bbolt"
+)
+
+// sampleSize is the dimensions of the sample to compare against for the given aspect ratio and multiple.
+// 0 is special in that it is always a 1x1.
+func sampleSize(aspectRatio image.Point, multiple int) image.Point {
+	if multiple == 0 {
+		return image.Point{X: 1, Y: 1}
+	}
+	return aspectRatio.Mul(multiple)
+}
+
+// searcher finds the k nearest samples to a query, sorted from nearest to farthest
+type searcher interface {
+	search(query []float64, k int, epsilon float64) []neighbor
+	// searchMasked compares only the pixels of the samples where visible is set
+	searchMasked(query []float64, visible []bool, k int) []neighbor
+}
+
+// scan compares every one of the vectors with distance, returning the k nearest
+func scan(ids []int, vectors [][]float64, k int, distance func(vector []float64) float64) []neighbor {
+	if k <= 0 {
+		return nil
+	}
+	h := make(neighborHeap, 0, k+1)
+	for i, vector := range vectors {
+		d := distance(vector)
+		if len(h) < k || d < h[0].distance {
+			heap.Push(&h, neighbor{id: ids[i], distance: d})
+			if len(h) > k {
+				heap.Pop(&h)
+			}
+		}
+	}
+	results := make([]neighbor, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(&h).(neighbor)
+	}
+	return results
+}
+
+// maskedDistance compares vectors to the visible pixels of query with distance. The distance is
+// averaged over the visible pixels only. It is not safe for concurrent use.
+func maskedDistance(distance DistanceFunc, query []float64, visible []bool) func(vector []float64) float64 {
+	compact := func(dst, src []float64) []float64 {
+		dst = dst[:0]
+		for i, ok := range visible {
+			if ok {
+				dst = append(dst, src[i*3:i*3+3]...)
+			}
+		}
+		return dst
+	}
+	visibleQuery := compact(nil, query)
+	buffer := make([]float64, 0, len(visibleQuery))
+	return func(vector []float64) float64 {
+		buffer = compact(buffer, vector)
+		return distance(visibleQuery, buffer)
+	}
+}
+
+// linearScan is a searcher that compares against every sample, for metrics that can't use a vpTree
+type linearScan struct {
+	ids      []int
+	vectors  [][]float64
+	distance DistanceFunc
+}
+
+func (l *linearScan) search(query []float64, k int, epsilon float64) []neighbor {
+	return scan(l.ids, l.vectors, k, func(vector []float64) float64 {
+		return l.distance(query, vector)
+	})
+}
+
+func (l *linearScan) searchMasked(query []float64, visible []bool, k int) []neighbor {
+	return scan(l.ids, l.vectors, k, maskedDistance(l.distance, query, visible))
+}
+
+// loadSearcher reads all of the lab samples in a dimension bucket into a single contiguous
+// array and builds a searcher over them. include, if not nil, picks the ids to load.
+func loadSearcher(dimensionBucket *bolt.Bucket, encoding labEncoding, metric Metric, include func(id int) bool) (searcher, error) {
+	ids := make([]int, 0)
+	data := make([]float64, 0)
+	if err := dimensionBucket.ForEach(func(k, v []byte) error {
+		id := bytesToInt(k)
+		if include != nil && !include(id) {
+			return nil
+		}
+		ids = append(ids, id)
+		data = append(data, encoding.decode(v)...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	vectors := make([][]float64, len(ids))
+	if len(ids) > 0 {
+		stride := len(data) / len(ids)
+		for i := range vectors {
+			vectors[i] = data[i*stride : (i+1)*stride : (i+1)*stride]
+		}
+	}
+	if !metric.TriangleInequality {
+		return &linearScan{ids: ids, vectors: vectors, distance: metric.Distance}, nil
+	}
+	return newVPTree(ids, vectors, metric.Distance), nil
+}
+
+// visiblePixels is which pixels of img are opaque enough to compare, or nil if they all are. A
+// completely transparent image is compared as if it were opaque.
+func visiblePixels(img *image.NRGBA) []bool {
+	size := img.Rect.Size()
+	visible := make([]bool, 0, size.X*size.Y)
+	some, all := false, true
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			ok := img.Pix[y*img.Stride+x*4+3] >= 0x80
+			visible = append(visible, ok)
+			some, all = some || ok, all && ok
+		}
+	}
+	if all || !some {
+		return nil
+	}
+	return visible
+}
+
+// searchSamples finds the k nearest samples to img, as well as to its rotation if the aspect ratio is
+// not square, and to its mirrored and upside down versions with augment. Each sample is only
+// reported once, for its nearest transform. Transparent pixels of img are not compared. searcher
+// looks up the searcher for a given sample size.
+func searchSamples(img *image.NRGBA, aspectRatio image.Point, multiple, k int, epsilon float64, augment bool, searcher func(image.Point) (searcher, error)) ([]neighbor, error) {
+	size := sampleSize(aspectRatio, multiple)
+	resized := imaging.Resize(img, size.X, size.Y, imaging.NearestNeighbor)
+
+	neighbors := make([]neighbor, 0)
+	for _, transform := range queryTransforms(size.X == size.Y, augment) {
+		query := resized
+		if transform != Identity {
+			query = transform.Apply(resized)
+		}
+		t, err := searcher(query.Rect.Size())
+		if err != nil {
+			return nil, err
+		}
+		var found []neighbor
+		if visible := visiblePixels(query); visible != nil {
+			found = t.searchMasked(analysis.RGBAToLab(query.Pix), visible, k)
+		} else {
+			found = t.search(analysis.RGBAToLab(query.Pix), k, epsilon)
+		}
+		for _, n := range found {
+			// The query matched the sample after transform, so the sample matches after the inverse
+			n.transform = transform.Inverse()
+			neighbors = append(neighbors, n)
+		}
+	}
+	sort.SliceStable(neighbors, func(i, j int) bool {
+		return neighbors[i].distance < neighbors[j].distance
+	})
+	// Every query found k distinct samples if there were that many, so there are still k after
+	// dropping the repeats
+	seen := make(map[int]bool)
+	unique := neighbors[:0]
+	for _, n := range neighbors {
+		if !seen[n.id] && len(unique) < k {
+			seen[n.id] = true
+			unique = append(unique, n)
+		}
+	}
+	return unique, nil
+}
+
+// sourceAspectRatioFilter returns the ids to include for options.SourceAspectRatio, or nil to include
+// every id. Images indexed before their aspect ratio was recorded are always included.
+func sourceAspectRatioFilter(rootBucket *bolt.Bucket, options Options) func(id int) bool {
+	aspectRatiosBucket := rootBucket.Bucket(aspectRatiosKey)
+	if options.SourceAspectRatio == nil || aspectRatiosBucket == nil {
+		return nil
+	}
+	return func(id int) bool {
+		aspectRatio := aspectRatiosBucket.Get(intToBytes(id))
+		return aspectRatio == nil || options.SourceAspectRatio(bytesToPoint(aspectRatio))
+	}
+}
+
+// toCandidates resolves the ids of the neighbors to image names
+func toCandidates(neighbors []neighbor, name func(id int) (string, error)) ([]Candidate, error) {
+	candidates := make([]Candidate, len(neighbors))
+	for i, n := range neighbors {
+		var err error
+		if candidates[i].Name, err = name(n.id); err != nil {
+			return nil, err
+		}
+		candidates[i].Distance = n.distance
+		candidates[i].Transform = n.transform
+	}
+	return candidates, nil
+}
+
+// searchRand is the random number generator for a search of img. With a seed, it is derived from
+// the seed and the pixels of img, so the same search always makes the same choice.
+func searchRand(img *image.NRGBA, seed int64) *rand.Rand {
+	if seed == 0 {
+		return rand.New(rand.NewSource(rand.Int63()))
+	}
+	h := fnv.New64a()
+	h.Write(img.Pix)
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
+
+// searchFuzzy picks one of the top fuzziness candidates at random
+func searchFuzzy(i Index, img *image.NRGBA, aspectRatio image.Point, fuzziness int, seed int64) (string, error) {
+	candidates, err := i.SearchTopK(img, aspectRatio, fuzziness)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no matching image found")
+	}
+	// There are fewer candidates than fuzziness if the index is small
+	return candidates[searchRand(img, seed).Intn(len(candidates))].Name, nil
+}
@@ -0,0 +1,69 @@
+package index
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/timwu/mosaicer/analysis"
+)
+
+func TestSearchTopK(t *testing.T) {
+	// L* of 0, 0.1, 0.2, 0.3 and 0.4 on the go-colorful scale, with no color
+	src := indexTestImages(t, "a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg")
+	imgIndex, err := NewBoltIndex(src, Options{Multiple: 0, Fuzziness: 10, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imgIndex.(*boltIndex).db.Close()
+	samples := map[string]float64{"a.jpg": 0, "b.jpg": 0.1, "c.jpg": 0.2, "d.jpg": 0.3, "e.jpg": 0.4}
+
+	tests := []struct {
+		query    color.NRGBA
+		k        int
+		expected []string
+	}{
+		{color.NRGBA{A: 255}, 1, []string{"a.jpg"}},
+		{color.NRGBA{A: 255}, 3, []string{"a.jpg", "b.jpg", "c.jpg"}},
+		{color.NRGBA{R: 255, G: 255, B: 255, A: 255}, 2, []string{"e.jpg", "d.jpg"}},
+		// L* of about 0.27
+		{color.NRGBA{R: 64, G: 64, B: 64, A: 255}, 5, []string{"d.jpg", "c.jpg", "e.jpg", "b.jpg", "a.jpg"}},
+		// Asking for more than there are returns them all
+		{color.NRGBA{R: 64, G: 64, B: 64, A: 255}, 10, []string{"d.jpg", "c.jpg", "e.jpg", "b.jpg", "a.jpg"}},
+		{color.NRGBA{A: 255}, 0, []string{}},
+	}
+	for _, test := range tests {
+		query := imaging.New(40, 30, test.query)
+		candidates, err := imgIndex.SearchTopK(query, image.Point{X: 4, Y: 3}, test.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(candidates) != len(test.expected) {
+			t.Fatalf("%v k=%d: found %v, expected %v", test.query, test.k, candidates, test.expected)
+		}
+		lab := analysis.RGBAToLab(query.Pix[:4])
+		for i, candidate := range candidates {
+			if candidate.Name != test.expected[i] {
+				t.Fatalf("%v k=%d: found %v, expected %v", test.query, test.k, candidates, test.expected)
+			}
+			if expected := floatDistance(lab, []float64{samples[candidate.Name], 0, 0}); math.Abs(candidate.Distance-expected) > 1e-9 {
+				t.Fatalf("%v k=%d: %s is at distance %v, expected %v", test.query, test.k, candidate.Name, candidate.Distance, expected)
+			}
+		}
+	}
+
+	// Search picks from all of the images when there are fewer than the fuzziness
+	picked := make(map[string]bool)
+	for i := 0; i < 256; i++ {
+		name, err := imgIndex.Search(imaging.New(40, 30, color.NRGBA{R: uint8(i), G: uint8(i), B: uint8(i), A: 255}), image.Point{X: 4, Y: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[name] = true
+	}
+	if len(picked) != len(samples) {
+		t.Fatalf("Search only picked %v", picked)
+	}
+}
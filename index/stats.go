@@ -0,0 +1,226 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/timwu/mosaicer/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// gamutBinSize is the size of the L*a*b* cells used to measure gamut coverage, in the usual 0-100 L* scale
+const gamutBinSize = 10.0
+
+// DimensionStats describes one sample dimension bucket in lab_data
+type DimensionStats struct {
+	Width   int   `json:"width"`
+	Height  int   `json:"height"`
+	Samples int   `json:"samples"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// GamutStats describes the range of L*a*b* colors in the samples, in the usual 0-100 L* scale
+type GamutStats struct {
+	MinL float64 `json:"min_l"`
+	MaxL float64 `json:"max_l"`
+	MinA float64 `json:"min_a"`
+	MaxA float64 `json:"max_a"`
+	MinB float64 `json:"min_b"`
+	MaxB float64 `json:"max_b"`
+	// Fraction of the sRGB gamut, split into cells of gamutBinSize, that has at least one sample pixel
+	Coverage float64 `json:"coverage"`
+}
+
+// Stats summarizes an index
+type Stats struct {
+	Metadata   *Metadata        `json:"metadata"`
+	Images     int              `json:"images"`
+	Dimensions []DimensionStats `json:"dimensions"`
+	// Number of images by aspect ratio before cropping. Images indexed before the aspect
+	// ratio was recorded are counted by their cropped aspect ratio.
+	AspectRatios map[string]int `json:"aspect_ratios"`
+	// Images that were indexed but have no samples because of their aspect ratio
+	Skipped []string   `json:"skipped"`
+	Gamut   GamutStats `json:"gamut"`
+	// Bytes in use by each bucket under the root
+	BucketBytes map[string]int64 `json:"bucket_bytes"`
+	FileBytes   int64            `json:"file_bytes"`
+}
+
+func bucketBytes(bucket *bolt.Bucket) int64 {
+	stats := bucket.Stats()
+	return int64(stats.BranchInuse + stats.LeafInuse + stats.InlineBucketInuse)
+}
+
+func formatAspectRatio(aspectRatio image.Point) string {
+	return fmt.Sprintf("%d:%d", aspectRatio.X, aspectRatio.Y)
+}
+
+// gamutBin is the cell of an L*a*b* color scaled as go-colorful does
+func gamutBin(l, a, b float64) [3]int {
+	return [3]int{
+		int(math.Floor(l * labScale / gamutBinSize)),
+		int(math.Floor(a * labScale / gamutBinSize)),
+		int(math.Floor(b * labScale / gamutBinSize)),
+	}
+}
+
+// srgbGamutBins finds every cell that some sRGB color falls in
+func srgbGamutBins() map[[3]int]bool {
+	const step = 1.0 / 32
+	bins := make(map[[3]int]bool)
+	for r := 0.0; r <= 1; r += step {
+		for g := 0.0; g <= 1; g += step {
+			for b := 0.0; b <= 1; b += step {
+				bins[gamutBin(colorful.Color{R: r, G: g, B: b}.Lab())] = true
+			}
+		}
+	}
+	return bins
+}
+
+// ReadStats summarizes the index for source
+func ReadStats(source string) (*Stats, error) {
+	fileInfo, err := os.Stat(source + Suffix)
+	if err != nil {
+		return nil, err
+	}
+	db, err := boltDB(source)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	stats := &Stats{
+		Dimensions:   make([]DimensionStats, 0),
+		AspectRatios: make(map[string]int),
+		Skipped:      make([]string, 0),
+		BucketBytes:  make(map[string]int64),
+		FileBytes:    fileInfo.Size(),
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket(rootKey)
+		if rootBucket == nil {
+			return fmt.Errorf("index for %s is empty", source)
+		}
+		var err error
+		if stats.Metadata, err = readMetadata(rootBucket); err != nil {
+			return err
+		}
+		if stats.Metadata == nil {
+			return fmt.Errorf("index for %s is empty", source)
+		}
+		if err := rootBucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				stats.BucketBytes[string(k)] = bucketBytes(rootBucket.Bucket(k))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		encoding, err := getEncoding(stats.Metadata.Encoding)
+		if err != nil {
+			return err
+		}
+
+		// ids with samples, and the largest sample dimensions of each in case the aspect ratio wasn't recorded
+		sampled := make(map[int]image.Point)
+		gamutBins := make(map[[3]int]bool)
+		gamut := GamutStats{MinL: math.Inf(1), MaxL: math.Inf(-1), MinA: math.Inf(1), MaxA: math.Inf(-1), MinB: math.Inf(1), MaxB: math.Inf(-1)}
+		if labDataBucket := rootBucket.Bucket(labDataKey); labDataBucket != nil {
+			if err := labDataBucket.ForEach(func(k, v []byte) error {
+				dimensionBucket := labDataBucket.Bucket(k)
+				if dimensionBucket == nil {
+					return nil
+				}
+				size := bytesToPoint(k)
+				dimension := DimensionStats{Width: size.X, Height: size.Y, Bytes: bucketBytes(dimensionBucket)}
+				if err := dimensionBucket.ForEach(func(id, sample []byte) error {
+					dimension.Samples++
+					if largest := sampled[bytesToInt(id)]; size.X*size.Y > largest.X*largest.Y {
+						sampled[bytesToInt(id)] = size
+					}
+					lab := encoding.decode(sample)
+					for i := 0; i < len(lab); i += 3 {
+						gamut.MinL, gamut.MaxL = math.Min(gamut.MinL, lab[i]*labScale), math.Max(gamut.MaxL, lab[i]*labScale)
+						gamut.MinA, gamut.MaxA = math.Min(gamut.MinA, lab[i+1]*labScale), math.Max(gamut.MaxA, lab[i+1]*labScale)
+						gamut.MinB, gamut.MaxB = math.Min(gamut.MinB, lab[i+2]*labScale), math.Max(gamut.MaxB, lab[i+2]*labScale)
+						gamutBins[gamutBin(lab[i], lab[i+1], lab[i+2])] = true
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+				stats.Dimensions = append(stats.Dimensions, dimension)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		srgbBins := srgbGamutBins()
+		covered := 0
+		for bin := range gamutBins {
+			if srgbBins[bin] {
+				covered++
+			}
+		}
+		if len(gamutBins) > 0 {
+			gamut.Coverage = float64(covered) / float64(len(srgbBins))
+			stats.Gamut = gamut
+		}
+
+		aspectRatiosBucket := rootBucket.Bucket(aspectRatiosKey)
+		if namesBucket := rootBucket.Bucket(namesKey); namesBucket != nil {
+			if err := namesBucket.ForEach(func(k, v []byte) error {
+				stats.Images++
+				id := bytesToInt(k)
+				size, ok := sampled[id]
+				if !ok {
+					stats.Skipped = append(stats.Skipped, string(v))
+				}
+				if aspectRatiosBucket != nil {
+					if aspectRatio := aspectRatiosBucket.Get(k); aspectRatio != nil {
+						stats.AspectRatios[formatAspectRatio(bytesToPoint(aspectRatio))]++
+						return nil
+					}
+				}
+				if ok && size.X*size.Y > 1 {
+					stats.AspectRatios[formatAspectRatio(util.AspectRatio(image.Rectangle{Max: size}))]++
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(stats.Dimensions, func(i, j int) bool {
+		left, right := stats.Dimensions[i], stats.Dimensions[j]
+		if left.Width*left.Height != right.Width*right.Height {
+			return left.Width*left.Height < right.Width*right.Height
+		}
+		return left.Width < right.Width
+	})
+	sort.Strings(stats.Skipped)
+	return stats, nil
+}
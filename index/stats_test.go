@@ -0,0 +1,117 @@
+package index
+
+import (
+	"image"
+	"path/filepath"
+	"testing"
+
+	"github.com/timwu/mosaicer/analysis"
+	"github.com/timwu/mosaicer/source"
+)
+
+// solidSamples is image data with a sample of each size, all of a single L*a*b* color
+func solidSamples(sourceAspectRatio image.Point, lab [3]float64, sizes ...image.Point) *analysis.ImageData {
+	data := &analysis.ImageData{SourceAspectRatio: sourceAspectRatio, LabSamples: make(map[image.Point][]float64)}
+	for _, size := range sizes {
+		sample := make([]float64, 0, 3*size.X*size.Y)
+		for i := 0; i < size.X*size.Y; i++ {
+			sample = append(sample, lab[:]...)
+		}
+		data.LabSamples[size] = sample
+	}
+	return data
+}
+
+func TestReadStats(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "photos")
+	metadata := testMetadata
+	metadata.Samples = 2
+	builder, err := NewBoltIndexBuilder(src, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	square, landscape, portrait := image.Point{X: 1, Y: 1}, image.Point{X: 4, Y: 3}, image.Point{X: 3, Y: 4}
+	gray, darkGray := [3]float64{0.5, 0, 0}, [3]float64{0.25, 0, 0}
+	// Far outside of what sRGB can show
+	red := [3]float64{0.5, 1.5, 0}
+	images := map[string]*analysis.ImageData{
+		"a.jpg": solidSamples(image.Point{X: 3, Y: 2}, gray, square, landscape),
+		// Indexed before the aspect ratio was recorded, so it falls back to the samples
+		"b.jpg": solidSamples(image.Point{}, darkGray, square, landscape),
+		"c.jpg": solidSamples(image.Point{}, red, square, portrait),
+		// Skipped, with and without a recorded aspect ratio
+		"d.jpg": solidSamples(image.Point{X: 21, Y: 9}, gray),
+		"e.jpg": solidSamples(image.Point{}, gray),
+	}
+	for name, data := range images {
+		if err := builder.Index(name, source.ImageInfo{}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builder.Close()
+
+	stats, err := ReadStats(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != 5 || *stats.Metadata != metadata {
+		t.Fatalf("Got %d images with %+v, expected 5 with %+v", stats.Images, stats.Metadata, metadata)
+	}
+	if len(stats.Skipped) != 2 || stats.Skipped[0] != "d.jpg" || stats.Skipped[1] != "e.jpg" {
+		t.Fatalf("Expected d.jpg and e.jpg to be skipped, got %v", stats.Skipped)
+	}
+	expectedAspectRatios := map[string]int{"3:2": 1, "4:3": 1, "3:4": 1, "21:9": 1}
+	if len(stats.AspectRatios) != len(expectedAspectRatios) {
+		t.Fatalf("Got aspect ratios %v, expected %v", stats.AspectRatios, expectedAspectRatios)
+	}
+	for aspectRatio, n := range expectedAspectRatios {
+		if stats.AspectRatios[aspectRatio] != n {
+			t.Fatalf("Got aspect ratios %v, expected %v", stats.AspectRatios, expectedAspectRatios)
+		}
+	}
+
+	// Ordered by area, then width
+	expectedDimensions := []DimensionStats{{Width: 1, Height: 1, Samples: 3}, {Width: 3, Height: 4, Samples: 1}, {Width: 4, Height: 3, Samples: 2}}
+	if len(stats.Dimensions) != len(expectedDimensions) {
+		t.Fatalf("Got dimensions %+v, expected %+v", stats.Dimensions, expectedDimensions)
+	}
+	for i, expected := range expectedDimensions {
+		actual := stats.Dimensions[i]
+		if actual.Width != expected.Width || actual.Height != expected.Height || actual.Samples != expected.Samples {
+			t.Fatalf("Got dimensions %+v, expected %+v", stats.Dimensions, expectedDimensions)
+		}
+		// Every sample is at least its float64 values
+		if minBytes := int64(expected.Samples * expected.Width * expected.Height * 3 * 8); actual.Bytes < minBytes || actual.Bytes > stats.FileBytes {
+			t.Fatalf("%dx%d uses %d bytes, expected at least %d", actual.Width, actual.Height, actual.Bytes, minBytes)
+		}
+	}
+
+	gamut := stats.Gamut
+	if gamut.MinL != 25 || gamut.MaxL != 50 || gamut.MinA != 0 || gamut.MaxA != 150 || gamut.MinB != 0 || gamut.MaxB != 0 {
+		t.Fatalf("Got gamut %+v", gamut)
+	}
+	// Only the two grays are in the sRGB gamut
+	if expected := 2 / float64(len(srgbGamutBins())); gamut.Coverage != expected {
+		t.Fatalf("Got gamut coverage %v, expected %v", gamut.Coverage, expected)
+	}
+}
+
+func TestReadStatsEmpty(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "photos")
+	builder, err := NewBoltIndexBuilder(src, testMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.Close()
+	stats, err := ReadStats(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != 0 || len(stats.Dimensions) != 0 || len(stats.Skipped) != 0 || len(stats.AspectRatios) != 0 || stats.Gamut != (GamutStats{}) {
+		t.Fatalf("Expected empty stats, got %+v", stats)
+	}
+
+	if _, err := ReadStats(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatalf("Expected an error for a missing index")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// Transform is a rotation or mirroring of an image
+type Transform int
+
+const (
+	Identity Transform = iota
+	// Rotate90 rotates counter-clockwise by 90 degrees, like imaging.Rotate90
+	Rotate90
+	Rotate180
+	Rotate270
+	FlipH
+	FlipV
+	// Transpose flips along the top left to bottom right diagonal
+	Transpose
+	// Transverse flips along the bottom left to top right diagonal
+	Transverse
+)
+
+var transformNames = []string{"identity", "rotate90", "rotate180", "rotate270", "fliph", "flipv", "transpose", "transverse"}
+
+func (t Transform) String() string {
+	if t < 0 || int(t) >= len(transformNames) {
+		return "unknown"
+	}
+	return transformNames[t]
+}
+
+// Apply returns img transformed by t
+func (t Transform) Apply(img image.Image) *image.NRGBA {
+	switch t {
+	case Rotate90:
+		return imaging.Rotate90(img)
+	case Rotate180:
+		return imaging.Rotate180(img)
+	case Rotate270:
+		return imaging.Rotate270(img)
+	case FlipH:
+		return imaging.FlipH(img)
+	case FlipV:
+		return imaging.FlipV(img)
+	case Transpose:
+		return imaging.Transpose(img)
+	case Transverse:
+		return imaging.Transverse(img)
+	}
+	return imaging.Clone(img)
+}
+
+// Inverse is the transform that undoes t
+func (t Transform) Inverse() Transform {
+	switch t {
+	case Rotate90:
+		return Rotate270
+	case Rotate270:
+		return Rotate90
+	}
+	return t
+}
+
+// Swapped is whether t swaps the width and height of an image
+func (t Transform) Swapped() bool {
+	return t == Rotate90 || t == Rotate270 || t == Transpose || t == Transverse
+}
+
+// queryTransforms are the transforms of a searched image to compare against the samples. Images
+// that are not square are also compared rotated, to match the samples of the other orientation.
+// With augment, the mirrored and upside down versions are compared too.
+func queryTransforms(square, augment bool) []Transform {
+	transforms := []Transform{Identity}
+	if !square {
+		transforms = append(transforms, Rotate90)
+	}
+	if augment {
+		transforms = append(transforms, FlipH, FlipV, Rotate180)
+		if !square {
+			transforms = append(transforms, Rotate270, Transpose, Transverse)
+		}
+	}
+	return transforms
+}
@@ -0,0 +1,59 @@
+package index
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/timwu/mosaicer/analysis"
+)
+
+func TestTransformInverse(t *testing.T) {
+	img := imaging.New(4, 3, color.NRGBA{0, 0, 0, 0xff})
+	img.SetNRGBA(0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0xff, 0, 0xff})
+	for transform := Identity; transform <= Transverse; transform++ {
+		transformed := transform.Apply(img)
+		if swapped := transformed.Rect.Size() != img.Rect.Size(); swapped != transform.Swapped() {
+			t.Fatalf("%v: got size %v", transform, transformed.Rect.Size())
+		}
+		if restored := transform.Inverse().Apply(transformed); string(restored.Pix) != string(img.Pix) {
+			t.Fatalf("%v: the inverse did not restore the image", transform)
+		}
+	}
+}
+
+func TestSearchSamplesAugment(t *testing.T) {
+	// The only sample is the query mirrored left to right
+	query := imaging.New(4, 3, color.NRGBA{0, 0, 0, 0xff})
+	query.SetNRGBA(0, 0, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	sample := imaging.FlipH(query)
+	tree := newVPTree([]int{1}, [][]float64{analysis.RGBAToLab(sample.Pix)}, floatDistance)
+	searcher := func(size image.Point) (searcher, error) {
+		if size == sample.Rect.Size() {
+			return tree, nil
+		}
+		return newVPTree(nil, nil, floatDistance), nil
+	}
+
+	neighbors, err := searchSamples(query, image.Point{4, 3}, 1, 5, 0, false, searcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(neighbors) != 1 || neighbors[0].distance == 0 || neighbors[0].transform != Identity {
+		t.Fatalf("Without augment, got %v", neighbors)
+	}
+
+	neighbors, err = searchSamples(query, image.Point{4, 3}, 1, 5, 0, true, searcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sample is only reported once, for its exact match
+	if len(neighbors) != 1 || neighbors[0].distance != 0 || neighbors[0].transform != FlipH {
+		t.Fatalf("With augment, got %v", neighbors)
+	}
+	if string(neighbors[0].transform.Apply(sample).Pix) != string(query.Pix) {
+		t.Fatalf("The transform does not turn the sample into the query")
+	}
+}
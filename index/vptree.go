@@ -0,0 +1,163 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// neighbor is a single search result from a vpTree
+type neighbor struct {
+	id       int
+	distance float64
+	// Transform of the sample that matched, see Candidate
+	transform Transform
+}
+
+// neighborHeap is a max-heap on distance, used to hold the best k neighbors seen so far
+type neighborHeap []neighbor
+
+func (h neighborHeap) Len() int            { return len(h) }
+func (h neighborHeap) Less(i, j int) bool  { return h[i].distance > h[j].distance }
+func (h neighborHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *neighborHeap) Push(x interface{}) { *h = append(*h, x.(neighbor)) }
+func (h *neighborHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+type vpNode struct {
+	// index into the tree's vectors of the vantage point
+	point int
+	// points closer than threshold to the vantage point are in inside, the rest in outside
+	threshold float64
+	inside    *vpNode
+	outside   *vpNode
+}
+
+// vpTree is a vantage point tree over L*a*b* sample vectors. The distance function
+// must be a metric (satisfy the triangle inequality) for searches to be exact.
+type vpTree struct {
+	root     *vpNode
+	ids      []int
+	vectors  [][]float64
+	distance DistanceFunc
+}
+
+// newVPTree builds a vantage point tree over the given vectors. ids[i] is the id reported for vectors[i].
+func newVPTree(ids []int, vectors [][]float64, distance DistanceFunc) *vpTree {
+	t := &vpTree{
+		ids:      ids,
+		vectors:  vectors,
+		distance: distance,
+	}
+	points := make([]int, len(vectors))
+	for i := range points {
+		points[i] = i
+	}
+	// Fixed seed so that the same data always builds the same tree
+	t.root = t.build(points, rand.New(rand.NewSource(1)))
+	return t
+}
+
+func (t *vpTree) build(points []int, r *rand.Rand) *vpNode {
+	if len(points) == 0 {
+		return nil
+	}
+	// Move a random vantage point to the front
+	i := r.Intn(len(points))
+	points[0], points[i] = points[i], points[0]
+	node := &vpNode{point: points[0]}
+	rest := points[1:]
+	if len(rest) == 0 {
+		return node
+	}
+
+	vp := t.vectors[node.point]
+	distances := make(map[int]float64, len(rest))
+	for _, p := range rest {
+		distances[p] = t.distance(vp, t.vectors[p])
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return distances[rest[i]] < distances[rest[j]]
+	})
+	median := len(rest) / 2
+	node.threshold = distances[rest[median]]
+	node.inside = t.build(rest[:median], r)
+	node.outside = t.build(rest[median:], r)
+	return node
+}
+
+// searchMasked can't use the tree, since masked distances don't have to agree with the tree's
+func (t *vpTree) searchMasked(query []float64, visible []bool, k int) []neighbor {
+	return scan(t.ids, t.vectors, k, maskedDistance(t.distance, query, visible))
+}
+
+// search finds the k nearest vectors to the query, sorted from nearest to farthest.
+// epsilon > 0 allows approximate results that are within a factor of (1 + epsilon) of the true
+// k-th nearest distance in exchange for visiting fewer nodes. epsilon == 0 is an exact search.
+func (t *vpTree) search(query []float64, k int, epsilon float64) []neighbor {
+	if k <= 0 {
+		return nil
+	}
+	h := make(neighborHeap, 0, k+1)
+	tau := math.Inf(1)
+	var visit func(node *vpNode)
+	visit = func(node *vpNode) {
+		if node == nil {
+			return
+		}
+		d := t.distance(query, t.vectors[node.point])
+		if d < tau || len(h) < k {
+			heap.Push(&h, neighbor{id: t.ids[node.point], distance: d})
+			if len(h) > k {
+				heap.Pop(&h)
+			}
+			if len(h) == k {
+				tau = h[0].distance
+			}
+		}
+		radius := tau / (1 + epsilon)
+		if d < node.threshold {
+			if d-radius <= node.threshold {
+				visit(node.inside)
+			}
+			radius = tau / (1 + epsilon)
+			if d+radius >= node.threshold {
+				visit(node.outside)
+			}
+		} else {
+			if d+radius >= node.threshold {
+				visit(node.outside)
+			}
+			radius = tau / (1 + epsilon)
+			if d-radius <= node.threshold {
+				visit(node.inside)
+			}
+		}
+	}
+	visit(t.root)
+
+	results := make([]neighbor, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(&h).(neighbor)
+	}
+	return results
+}
@@ -0,0 +1,79 @@
+package index
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomVectors(r *rand.Rand, n, dims int) [][]float64 {
+	vectors := make([][]float64, n)
+	for i := range vectors {
+		vectors[i] = make([]float64, dims)
+		for j := 0; j < dims; j += 3 {
+			vectors[i][j] = r.Float64() * 100
+			vectors[i][j+1] = r.Float64()*256 - 128
+			vectors[i][j+2] = r.Float64()*256 - 128
+		}
+	}
+	return vectors
+}
+
+func TestVPTreeMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	vectors := randomVectors(r, 2000, 3*12)
+	ids := make([]int, len(vectors))
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	tree := newVPTree(ids, vectors, floatDistance)
+
+	for _, query := range randomVectors(r, 50, 3*12) {
+		expected := make([]float64, len(vectors))
+		for i, v := range vectors {
+			expected[i] = floatDistance(query, v)
+		}
+		sort.Float64s(expected)
+
+		results := tree.search(query, 10, 0)
+		if len(results) != 10 {
+			t.Fatalf("Got %d results, expected 10", len(results))
+		}
+		for i, result := range results {
+			if result.distance != expected[i] {
+				t.Fatalf("Result %d has distance %v, expected %v", i, result.distance, expected[i])
+			}
+			if actual := floatDistance(query, vectors[result.id-1]); actual != result.distance {
+				t.Fatalf("Result %d reported distance %v for id %d, actual %v", i, result.distance, result.id, actual)
+			}
+		}
+	}
+}
+
+func TestVPTreeSmall(t *testing.T) {
+	tree := newVPTree([]int{7}, [][]float64{{50, 0, 0}}, floatDistance)
+	results := tree.search([]float64{40, 0, 0}, 5, 0)
+	if len(results) != 1 || results[0].id != 7 || results[0].distance != 10 {
+		t.Fatalf("Got wrong results %v", results)
+	}
+
+	empty := newVPTree(nil, nil, floatDistance)
+	if results := empty.search([]float64{40, 0, 0}, 5, 0); len(results) != 0 {
+		t.Fatalf("Expected no results from an empty tree, got %v", results)
+	}
+}
+
+func TestSearchMasked(t *testing.T) {
+	// The first pixel of each vector matches the query, the second is far from it
+	vectors := [][]float64{{10, 0, 0, 90, 0, 0}, {50, 0, 0, 20, 0, 0}}
+	tree := newVPTree([]int{1, 2}, vectors, floatDistance)
+	query := []float64{10, 0, 0, 20, 0, 0}
+
+	if results := tree.search(query, 1, 0); results[0].id != 2 {
+		t.Fatalf("Unmasked search found id %d, expected 2", results[0].id)
+	}
+	results := tree.searchMasked(query, []bool{true, false}, 2)
+	if len(results) != 2 || results[0].id != 1 || results[0].distance != 0 || results[1].distance != 40 {
+		t.Fatalf("Masked search got wrong results %v", results)
+	}
+}
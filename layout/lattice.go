@@ -0,0 +1,153 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"fmt"
+	"image"
+)
+
+// Lattice is a layout of cells of the same shape, repeated in a regular pattern over the target
+// image. Cells at the edges can extend past the layout, and are cut off when drawn.
+type Lattice interface {
+	// Size is the size of the layout in units
+	Size() image.Point
+	// Cells lists every cell of the layout
+	Cells() []Cell
+	// Mask is the shape of a cell drawn at size pixels, opaque where the cell is visible. Nil
+	// means the whole rectangle of the cell is visible.
+	Mask(size image.Point) *image.Alpha
+}
+
+// NewLattice creates the lattice with name, with cells of aspectRatio that cover the same area as a
+// grid of cells. Names are "brick", "offset" and "hex".
+func NewLattice(name string, aspectRatio image.Point, cells image.Point) (Lattice, error) {
+	if aspectRatio.X <= 0 || aspectRatio.Y <= 0 {
+		return nil, fmt.Errorf("invalid aspect ratio %d:%d", aspectRatio.X, aspectRatio.Y)
+	}
+	if cells.X <= 0 || cells.Y <= 0 {
+		return nil, fmt.Errorf("invalid number of cells %v", cells)
+	}
+	switch name {
+	case "brick":
+		return &brick{aspectRatio: aspectRatio, cells: cells}, nil
+	case "offset":
+		return &brick{aspectRatio: aspectRatio, cells: cells, columns: true}, nil
+	case "hex":
+		return &hex{aspectRatio: aspectRatio, cells: cells}, nil
+	}
+	return nil, fmt.Errorf("unknown lattice %s", name)
+}
+
+// brick offsets every other row of a grid by half a cell, like the running bond of a brick wall.
+// With columns set, every other column is offset instead.
+type brick struct {
+	aspectRatio image.Point
+	cells       image.Point
+	columns     bool
+}
+
+// cellSize is in units, which are half of the aspect ratio so that the offset is a whole number of them
+func (b *brick) cellSize() image.Point {
+	return b.aspectRatio.Mul(2)
+}
+
+func (b *brick) Size() image.Point {
+	size := b.cellSize()
+	return image.Point{X: size.X * b.cells.X, Y: size.Y * b.cells.Y}
+}
+
+func (b *brick) Cells() []Cell {
+	size := b.cellSize()
+	// Work in rows and swap back for columns
+	cells, across := b.cells, size.X
+	if b.columns {
+		cells, across = image.Point{X: b.cells.Y, Y: b.cells.X}, size.Y
+	}
+	result := make([]Cell, 0, (cells.X+1)*cells.Y)
+	for i := 0; i < cells.Y; i++ {
+		offset, n := 0, cells.X
+		if i%2 == 1 {
+			offset, n = -across/2, cells.X+1
+		}
+		for j := 0; j < n; j++ {
+			min := image.Point{X: offset + j*across, Y: i * size.Y}
+			if b.columns {
+				min = image.Point{X: i * size.X, Y: offset + j*across}
+			}
+			result = append(result, Cell{Rect: image.Rectangle{Min: min, Max: min.Add(size)}, AspectRatio: b.aspectRatio})
+		}
+	}
+	return result
+}
+
+func (b *brick) Mask(size image.Point) *image.Alpha {
+	return nil
+}
+
+// hex lays out pointy topped hexagons, stretched to fill cells of the aspect ratio. Every other
+// row is offset by half a cell, and the rows overlap by a quarter of a cell so the hexagons fit
+// together.
+type hex struct {
+	aspectRatio image.Point
+	cells       image.Point
+}
+
+// cellSize is in units, which are a quarter of the aspect ratio so that the rows overlap by a whole number of them
+func (h *hex) cellSize() image.Point {
+	return h.aspectRatio.Mul(4)
+}
+
+func (h *hex) Size() image.Point {
+	size := h.cellSize()
+	return image.Point{X: size.X * h.cells.X, Y: size.Y * h.cells.Y}
+}
+
+func (h *hex) Cells() []Cell {
+	size := h.cellSize()
+	layoutSize := h.Size()
+	result := make([]Cell, 0)
+	// The first row starts a quarter cell up, so the gaps between the points of its hexagons are above the layout
+	for i, y := 0, -size.Y/4; y < layoutSize.Y; i, y = i+1, y+size.Y*3/4 {
+		offset, n := 0, h.cells.X
+		if i%2 == 1 {
+			offset, n = -size.X/2, h.cells.X+1
+		}
+		for j := 0; j < n; j++ {
+			min := image.Point{X: offset + j*size.X, Y: y}
+			result = append(result, Cell{Rect: image.Rectangle{Min: min, Max: min.Add(size)}, AspectRatio: h.aspectRatio})
+		}
+	}
+	return result
+}
+
+func (h *hex) Mask(size image.Point) *image.Alpha {
+	mask := image.NewAlpha(image.Rectangle{Max: size})
+	for y := 0; y < size.Y; y++ {
+		v := (float64(y) + 0.5) / float64(size.Y)
+		for x := 0; x < size.X; x++ {
+			u := (float64(x) + 0.5) / float64(size.X)
+			// The slanted edges run from the points at the top and bottom center to a quarter of the way down the sides
+			edge := u - 0.5
+			if edge < 0 {
+				edge = -edge
+			}
+			if v >= edge/2 && 1-v >= edge/2 {
+				mask.Pix[y*mask.Stride+x] = 0xff
+			}
+		}
+	}
+	return mask
+}
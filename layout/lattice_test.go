@@ -0,0 +1,62 @@
+package layout
+
+import (
+	"image"
+	"testing"
+)
+
+// coverage counts the cells covering each unit of the lattice, drawing each cell through its mask
+func coverage(t *testing.T, l Lattice) [][]int {
+	size := l.Size()
+	counts := make([][]int, size.Y)
+	for y := range counts {
+		counts[y] = make([]int, size.X)
+	}
+	for _, cell := range l.Cells() {
+		mask := l.Mask(cell.Rect.Size())
+		for y := cell.Rect.Min.Y; y < cell.Rect.Max.Y; y++ {
+			for x := cell.Rect.Min.X; x < cell.Rect.Max.X; x++ {
+				if mask != nil && mask.AlphaAt(x-cell.Rect.Min.X, y-cell.Rect.Min.Y).A == 0 {
+					continue
+				}
+				if y >= 0 && y < size.Y && x >= 0 && x < size.X {
+					counts[y][x]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestLatticeCoverage(t *testing.T) {
+	for _, name := range []string{"brick", "offset", "hex"} {
+		for _, aspectRatio := range []image.Point{{4, 3}, {1, 1}, {3, 4}} {
+			l, err := NewLattice(name, aspectRatio, image.Point{5, 4})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cell := range l.Cells() {
+				if size := cell.Rect.Size(); size.X*aspectRatio.Y != size.Y*aspectRatio.X {
+					t.Fatalf("%s: cell %v is not %v", name, cell.Rect, aspectRatio)
+				}
+				if !cell.Rect.Overlaps(image.Rectangle{Max: l.Size()}) {
+					t.Fatalf("%s: cell %v is outside of the layout", name, cell.Rect)
+				}
+			}
+			for y, row := range coverage(t, l) {
+				for x, count := range row {
+					// Hexagons share the pixels along their slanted edges
+					if count == 0 || (name != "hex" && count > 1) {
+						t.Fatalf("%s %v: unit (%d,%d) is covered by %d cells", name, aspectRatio, x, y, count)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNewLatticeUnknown(t *testing.T) {
+	if _, err := NewLattice("triangle", image.Point{4, 3}, image.Point{5, 4}); err == nil {
+		t.Fatalf("Expected an error for an unknown lattice")
+	}
+}
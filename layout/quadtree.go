@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"fmt"
+	"image"
+)
+
+// Quadtree lays out a target image as a grid of cells, each of which can be split into quarters
+// where the target needs more detail, down to a maximum depth. Every cell has the same aspect ratio.
+type Quadtree struct {
+	// Aspect ratio of the cells, which is also the size of the smallest cells in units
+	AspectRatio image.Point
+	// Number of cells in the grid before any are split
+	Cells image.Point
+	// Number of times a cell of the grid can be split
+	MaxDepth int
+}
+
+// NewQuadtree creates a layout of cells of aspectRatio
+func NewQuadtree(aspectRatio image.Point, cells image.Point, maxDepth int) (*Quadtree, error) {
+	if aspectRatio.X <= 0 || aspectRatio.Y <= 0 {
+		return nil, fmt.Errorf("invalid aspect ratio %d:%d", aspectRatio.X, aspectRatio.Y)
+	}
+	if cells.X <= 0 || cells.Y <= 0 {
+		return nil, fmt.Errorf("invalid number of cells %v", cells)
+	}
+	if maxDepth < 0 || maxDepth > 8 {
+		return nil, fmt.Errorf("max depth must be between 0 and 8, got %d", maxDepth)
+	}
+	return &Quadtree{AspectRatio: aspectRatio, Cells: cells, MaxDepth: maxDepth}, nil
+}
+
+// cellSize is the size of a cell of the grid in units
+func (q *Quadtree) cellSize() image.Point {
+	return q.AspectRatio.Mul(1 << q.MaxDepth)
+}
+
+// Size is the size of the layout in units
+func (q *Quadtree) Size() image.Point {
+	size := q.cellSize()
+	return image.Point{X: size.X * q.Cells.X, Y: size.Y * q.Cells.Y}
+}
+
+// Cell is the cell of the grid at p, before it is split
+func (q *Quadtree) Cell(p image.Point) Cell {
+	size := q.cellSize()
+	min := image.Point{X: p.X * size.X, Y: p.Y * size.Y}
+	return Cell{Rect: image.Rectangle{Min: min, Max: min.Add(size)}, AspectRatio: q.AspectRatio}
+}
+
+// Split recursively splits cell into quarters for as long as split returns true, until the cells
+// are the smallest size. Returns the cells that were not split.
+func (q *Quadtree) Split(cell Cell, split func(cell Cell) (bool, error)) ([]Cell, error) {
+	if cell.Rect.Dx() <= q.AspectRatio.X {
+		return []Cell{cell}, nil
+	}
+	ok, err := split(cell)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []Cell{cell}, nil
+	}
+	half := cell.Rect.Size().Div(2)
+	cells := make([]Cell, 0, 4)
+	for _, offset := range []image.Point{{0, 0}, {half.X, 0}, {0, half.Y}, {half.X, half.Y}} {
+		min := cell.Rect.Min.Add(offset)
+		quarter, err := q.Split(Cell{Rect: image.Rectangle{Min: min, Max: min.Add(half)}, AspectRatio: cell.AspectRatio}, split)
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, quarter...)
+	}
+	return cells, nil
+}
@@ -0,0 +1,60 @@
+package layout
+
+import (
+	"image"
+	"testing"
+)
+
+func TestQuadtreeSplit(t *testing.T) {
+	q, err := NewQuadtree(image.Point{4, 3}, image.Point{3, 2}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := q.Size(); size != (image.Point{48, 24}) {
+		t.Fatalf("Wrong size, got %v, expected (48,24)", size)
+	}
+	cell := q.Cell(image.Point{1, 1})
+	if cell.Rect != image.Rect(16, 12, 32, 24) {
+		t.Fatalf("Wrong cell, got %v", cell.Rect)
+	}
+
+	// Split only the top left quarters, which should give 3 quarters, 3 sixteenths and the top left sixteenth
+	cells, err := q.Split(cell, func(c Cell) (bool, error) {
+		return c.Rect.Min == cell.Rect.Min, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 7 {
+		t.Fatalf("Wrong number of cells, got %d, expected 7", len(cells))
+	}
+	area := 0
+	for i, c := range cells {
+		if !c.Rect.In(cell.Rect) {
+			t.Fatalf("Cell %v is outside of %v", c.Rect, cell.Rect)
+		}
+		if c.Rect.Dx()*3 != c.Rect.Dy()*4 || c.Rect.Dx() < 4 {
+			t.Fatalf("Cell %v has the wrong size", c.Rect)
+		}
+		for _, other := range cells[:i] {
+			if c.Rect.Overlaps(other.Rect) {
+				t.Fatalf("Cells %v and %v overlap", c.Rect, other.Rect)
+			}
+		}
+		area += c.Rect.Dx() * c.Rect.Dy()
+	}
+	if area != cell.Rect.Dx()*cell.Rect.Dy() {
+		t.Fatalf("Cells cover %d units, expected %d", area, cell.Rect.Dx()*cell.Rect.Dy())
+	}
+
+	// Cells of the smallest size are never split
+	cells, err = q.Split(cell, func(c Cell) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 16 {
+		t.Fatalf("Wrong number of cells, got %d, expected 16", len(cells))
+	}
+}
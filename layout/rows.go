@@ -0,0 +1,170 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layout
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// maxUnit caps the height of a row in units. Aspect ratios that don't divide it evenly get cells
+// that are rounded to the nearest unit.
+const maxUnit = 60
+
+// Cell is a single tile of a layout, in layout units
+type Cell struct {
+	Rect image.Rectangle
+	// Aspect ratio of the tile the cell is meant for, which Rect may only approximate
+	AspectRatio image.Point
+}
+
+// Rows lays out a target image as rows of equal height, each filled with cells of several aspect
+// ratios. Every row is filled exactly to the width of the layout.
+type Rows struct {
+	// Height of each row in units
+	Unit int
+	// Number of rows
+	Rows int
+	// Width of the layout in units
+	Width int
+
+	aspectRatios []image.Point
+	// widths[i] is the width of a cell of aspectRatios[i] in units
+	widths []int
+	// fillable[w] is whether a row can be filled exactly to width w
+	fillable []bool
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// NewRows creates a layout for an image of imageAspectRatio with about tilesAcross cells per row
+func NewRows(imageAspectRatio image.Point, aspectRatios []image.Point, tilesAcross int) (*Rows, error) {
+	if len(aspectRatios) == 0 {
+		return nil, fmt.Errorf("at least one aspect ratio is required")
+	}
+	if tilesAcross <= 0 {
+		return nil, fmt.Errorf("tiles across must be positive, got %d", tilesAcross)
+	}
+	// The smallest row height that every aspect ratio fits into a whole number of units
+	unit := 1
+	for _, aspectRatio := range aspectRatios {
+		if aspectRatio.X <= 0 || aspectRatio.Y <= 0 {
+			return nil, fmt.Errorf("invalid aspect ratio %d:%d", aspectRatio.X, aspectRatio.Y)
+		}
+		y := aspectRatio.Y / gcd(aspectRatio.X, aspectRatio.Y)
+		unit = unit / gcd(unit, y) * y
+		if unit > maxUnit {
+			unit = maxUnit
+			break
+		}
+	}
+	r := &Rows{
+		Unit:         unit,
+		aspectRatios: aspectRatios,
+		widths:       make([]int, len(aspectRatios)),
+	}
+	totalWidth := 0
+	maxWidth := 0
+	for i, aspectRatio := range aspectRatios {
+		r.widths[i] = int(math.Max(1, math.Round(float64(unit*aspectRatio.X)/float64(aspectRatio.Y))))
+		totalWidth += r.widths[i]
+		if r.widths[i] > maxWidth {
+			maxWidth = r.widths[i]
+		}
+	}
+
+	// Size the rows so that cells of the average width give tilesAcross per row
+	aspect := float64(imageAspectRatio.X) / float64(imageAspectRatio.Y)
+	averageWidth := float64(totalWidth) / float64(len(r.widths))
+	r.Rows = int(math.Max(1, math.Round(float64(tilesAcross)*averageWidth/(aspect*float64(unit)))))
+	width := int(math.Max(1, math.Round(aspect*float64(r.Rows*unit))))
+
+	// Not every width can be filled exactly, so use the nearest one that can
+	r.fillable = make([]bool, width+maxWidth+1)
+	r.fillable[0] = true
+	for w := 1; w < len(r.fillable); w++ {
+		for _, cellWidth := range r.widths {
+			if cellWidth <= w && r.fillable[w-cellWidth] {
+				r.fillable[w] = true
+				break
+			}
+		}
+	}
+	for delta := 0; delta <= maxWidth; delta++ {
+		if width-delta > 0 && r.fillable[width-delta] {
+			r.Width = width - delta
+			break
+		}
+		if r.fillable[width+delta] {
+			r.Width = width + delta
+			break
+		}
+	}
+	if r.Width == 0 {
+		return nil, fmt.Errorf("can't fill rows of width %d with aspect ratios %v", width, aspectRatios)
+	}
+	r.fillable = r.fillable[:r.Width+1]
+	return r, nil
+}
+
+// Size is the size of the layout in units
+func (r *Rows) Size() image.Point {
+	return image.Point{X: r.Width, Y: r.Rows * r.Unit}
+}
+
+// Row fills row i from left to right. At each position, choose is given every cell that still
+// lets the rest of the row be filled exactly, and returns the index of the one to use.
+func (r *Rows) Row(i int, choose func(options []Cell) (int, error)) ([]Cell, error) {
+	if i < 0 || i >= r.Rows {
+		return nil, fmt.Errorf("row %d out of range [0, %d)", i, r.Rows)
+	}
+	cells := make([]Cell, 0)
+	for x := 0; x < r.Width; {
+		options := make([]Cell, 0, len(r.widths))
+		for j, cellWidth := range r.widths {
+			if x+cellWidth <= r.Width && r.fillable[r.Width-x-cellWidth] {
+				options = append(options, Cell{
+					Rect:        image.Rect(x, i*r.Unit, x+cellWidth, (i+1)*r.Unit),
+					AspectRatio: r.aspectRatios[j],
+				})
+			}
+		}
+		chosen, err := choose(options)
+		if err != nil {
+			return nil, err
+		}
+		if chosen < 0 || chosen >= len(options) {
+			return nil, fmt.Errorf("chose cell %d of %d", chosen, len(options))
+		}
+		cells = append(cells, options[chosen])
+		x = options[chosen].Rect.Max.X
+	}
+	return cells, nil
+}
+
+// Scale converts a rectangle in layout units to pixels, at pixelsPerUnit. Adjacent rectangles stay
+// adjacent after rounding.
+func Scale(rect image.Rectangle, pixelsPerUnit float64) image.Rectangle {
+	scale := func(v int) int {
+		return int(math.Round(float64(v) * pixelsPerUnit))
+	}
+	return image.Rect(scale(rect.Min.X), scale(rect.Min.Y), scale(rect.Max.X), scale(rect.Max.Y))
+}
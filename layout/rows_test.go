@@ -0,0 +1,65 @@
+package layout
+
+import (
+	"image"
+	"testing"
+)
+
+func TestNewRowsUnit(t *testing.T) {
+	rows, err := NewRows(image.Point{4, 3}, []image.Point{{1, 1}, {3, 2}, {16, 9}}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows.Unit != 18 {
+		t.Fatalf("Wrong unit, got %d, expected 18", rows.Unit)
+	}
+	expected := []int{18, 27, 32}
+	for i, w := range rows.widths {
+		if w != expected[i] {
+			t.Fatalf("Wrong cell widths, got %v, expected %v", rows.widths, expected)
+		}
+	}
+}
+
+func TestRowsFillExactly(t *testing.T) {
+	aspectRatios := []image.Point{{1, 1}, {3, 2}, {16, 9}, {2, 3}}
+	for _, imageAspectRatio := range []image.Point{{4, 3}, {16, 9}, {1, 1}, {3, 4}} {
+		rows, err := NewRows(imageAspectRatio, aspectRatios, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < rows.Rows; i++ {
+			// Always pick the widest cell, which has to be steered away from overrunning the row
+			cells, err := rows.Row(i, func(options []Cell) (int, error) {
+				widest := 0
+				for j, option := range options {
+					if option.Rect.Dx() > options[widest].Rect.Dx() {
+						widest = j
+					}
+				}
+				return widest, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			x := 0
+			for _, cell := range cells {
+				if cell.Rect.Min.X != x || cell.Rect.Min.Y != i*rows.Unit || cell.Rect.Dy() != rows.Unit {
+					t.Fatalf("Cell %v does not follow on from x=%d in row %d", cell.Rect, x, i)
+				}
+				x = cell.Rect.Max.X
+			}
+			if x != rows.Width {
+				t.Fatalf("Row %d filled to %d, expected %d", i, x, rows.Width)
+			}
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	left := Scale(image.Rect(0, 0, 3, 3), 10.0/3.0)
+	right := Scale(image.Rect(3, 0, 7, 3), 10.0/3.0)
+	if left.Max.X != right.Min.X {
+		t.Fatalf("Scaled cells %v and %v are not adjacent", left, right)
+	}
+}
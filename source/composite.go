@@ -0,0 +1,109 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+const namespaceSeparator = "::"
+
+// JoinNamespace prefixes name with the namespace of the source it belongs to
+func JoinNamespace(namespace, name string) string {
+	return namespace + namespaceSeparator + name
+}
+
+// SplitNamespace splits a name created by JoinNamespace
+func SplitNamespace(joinedName string) (string, string, error) {
+	splitName := strings.SplitN(joinedName, namespaceSeparator, 2)
+	if len(splitName) != 2 {
+		return "", "", fmt.Errorf("name %s has no namespace", joinedName)
+	}
+	return splitName[0], splitName[1], nil
+}
+
+type compositeSource struct {
+	namespaces []string
+	sources    map[string]ImageSource
+}
+
+func (c *compositeSource) GetImageNames() ([]string, error) {
+	names := make([]string, 0)
+	for _, namespace := range c.namespaces {
+		sourceNames, err := c.sources[namespace].GetImageNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range sourceNames {
+			names = append(names, JoinNamespace(namespace, name))
+		}
+	}
+	return names, nil
+}
+
+func (c *compositeSource) source(joinedName string) (ImageSource, string, error) {
+	namespace, name, err := SplitNamespace(joinedName)
+	if err != nil {
+		return nil, "", err
+	}
+	src := c.sources[namespace]
+	if src == nil {
+		return nil, "", fmt.Errorf("no source for namespace %s", namespace)
+	}
+	return src, name, nil
+}
+
+func (c *compositeSource) GetImage(joinedName string) (image.Image, error) {
+	src, name, err := c.source(joinedName)
+	if err != nil {
+		return nil, err
+	}
+	return src.GetImage(name)
+}
+
+func (c *compositeSource) GetImageInfo(joinedName string) (ImageInfo, error) {
+	src, name, err := c.source(joinedName)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	return src.GetImageInfo(name)
+}
+
+func (c *compositeSource) Close() {
+	for _, src := range c.sources {
+		src.Close()
+	}
+}
+
+// NewCompositeSource combines several sources into one. The name of every image is namespaced
+// with the corresponding entry of namespaces using JoinNamespace.
+func NewCompositeSource(namespaces []string, sources []ImageSource) (ImageSource, error) {
+	if len(namespaces) != len(sources) {
+		return nil, fmt.Errorf("got %d namespaces for %d sources", len(namespaces), len(sources))
+	}
+	c := &compositeSource{
+		namespaces: namespaces,
+		sources:    make(map[string]ImageSource),
+	}
+	for i, namespace := range namespaces {
+		if c.sources[namespace] != nil {
+			return nil, fmt.Errorf("duplicate namespace %s", namespace)
+		}
+		c.sources[namespace] = sources[i]
+	}
+	return c, nil
+}
@@ -39,6 +39,10 @@ func (c *cropSource) GetImageNames() ([]string, error) {
 	return c.src.GetImageNames()
 }
 
+func (c *cropSource) GetImageInfo(name string) (ImageInfo, error) {
+	return c.src.GetImageInfo(name)
+}
+
 func (c *cropSource) Close() {
 	c.src.Close()
 }
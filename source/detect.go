@@ -20,17 +20,23 @@ import (
 	"path"
 )
 
-// NewImageSource detects the type of the target and creates the appropriate ImageSource
+// NewImageSource detects the type of the target and creates the appropriate ImageSource. The
+// sub-crops of its images can also be gotten by the names from SubCrop.Name.
 func NewImageSource(target string) (ImageSource, error) {
 	fileInfo, err := os.Stat(target)
 	if err != nil {
 		return nil, err
 	}
+	var src ImageSource
 	if fileInfo.IsDir() {
-		return NewFolderImageSource(target)
+		src, err = NewFolderImageSource(target)
+	} else if path.Ext(fileInfo.Name()) == ".zip" {
+		src, err = NewZipImageSource(target)
+	} else {
+		return nil, fmt.Errorf("unrecognized input type %s", target)
 	}
-	if path.Ext(fileInfo.Name()) == ".zip" {
-		return NewZipImageSource(target)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("unrecognized input type %s", target)
+	return NewSubCropSource(src), nil
 }
@@ -89,6 +89,22 @@ func (f folderImageSource) GetImage(name string) (image.Image, error) {
 	return img, err
 }
 
+func (f folderImageSource) GetImageInfo(name string) (ImageInfo, error) {
+	if zipFileName, imageFileName, err := splitZipFileName(name); err == nil {
+		zipImageSource, err := NewZipImageSource(path.Join(f.dir, zipFileName))
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		defer zipImageSource.Close()
+		return zipImageSource.GetImageInfo(imageFileName)
+	}
+	fileInfo, err := os.Stat(path.Join(f.dir, name))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	return ImageInfo{Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
 func (f folderImageSource) Close() {}
 
 // NewFolderImageSource creates a folder-backed ImageSource
@@ -16,6 +16,7 @@ package source
 
 import (
 	"image"
+	"time"
 
 	// Import image formats
 	_ "image/gif"
@@ -32,9 +33,16 @@ var (
 	}
 )
 
+// ImageInfo describes the file backing an image, used to detect when it has changed
+type ImageInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
 // ImageSource is an interface for describing a source of images
 type ImageSource interface {
 	GetImageNames() ([]string, error)
 	GetImage(name string) (image.Image, error)
+	GetImageInfo(name string) (ImageInfo, error)
 	Close()
 }
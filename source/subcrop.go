@@ -0,0 +1,121 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const subCropSeparator = "#crop="
+
+// SubCrop is a part of an image: the largest crop of the image to AspectRatio, zoomed in on
+type SubCrop struct {
+	AspectRatio image.Point
+	// Size of the sub-crop as a percentage of the largest crop
+	Scale int
+	// Position of the sub-crop in the space left around it, as percentages from the left and the top
+	X, Y int
+}
+
+// SubCropGrid is an n by n grid of sub-crops at scale percent, spread evenly from the top left to
+// the bottom right of the image
+func SubCropGrid(aspectRatio image.Point, n, scale int) []SubCrop {
+	crops := make([]SubCrop, 0, n*n)
+	position := func(i int) int {
+		if n == 1 {
+			return 50
+		}
+		return i * 100 / (n - 1)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			crops = append(crops, SubCrop{AspectRatio: aspectRatio, Scale: scale, X: position(j), Y: position(i)})
+		}
+	}
+	return crops
+}
+
+// Name is the name of the sub-crop of the image with name
+func (c SubCrop) Name(name string) string {
+	return fmt.Sprintf("%s%s%dx%d,%d,%d,%d", name, subCropSeparator, c.AspectRatio.X, c.AspectRatio.Y, c.Scale, c.X, c.Y)
+}
+
+// SplitSubCrop splits a name created by SubCrop.Name into the name of the image and the sub-crop.
+// Returns false if name is not a sub-crop.
+func SplitSubCrop(name string) (string, SubCrop, bool) {
+	i := strings.LastIndex(name, subCropSeparator)
+	if i < 0 {
+		return name, SubCrop{}, false
+	}
+	var c SubCrop
+	if _, err := fmt.Sscanf(name[i+len(subCropSeparator):], "%dx%d,%d,%d,%d", &c.AspectRatio.X, &c.AspectRatio.Y, &c.Scale, &c.X, &c.Y); err != nil ||
+		c.AspectRatio.X <= 0 || c.AspectRatio.Y <= 0 || c.Scale <= 0 || c.Scale > 100 {
+		return name, SubCrop{}, false
+	}
+	return name[:i], c, true
+}
+
+// BaseName is the name of the image that name is a sub-crop of, or name itself if it is not a sub-crop
+func BaseName(name string) string {
+	base, _, _ := SplitSubCrop(name)
+	return base
+}
+
+// Apply crops img to the sub-crop
+func (c SubCrop) Apply(img image.Image) image.Image {
+	largest := CropImageToAspectRatio(img, c.AspectRatio)
+	bounds := largest.Bounds()
+	size := bounds.Size().Mul(c.Scale).Div(100)
+	min := bounds.Min.Add(image.Point{
+		X: (bounds.Dx() - size.X) * c.X / 100,
+		Y: (bounds.Dy() - size.Y) * c.Y / 100,
+	})
+	return imaging.Crop(largest, image.Rectangle{Min: min, Max: min.Add(size)})
+}
+
+// subCropSource serves the sub-crops of the images of another source, by the names from SubCrop.Name
+type subCropSource struct {
+	src ImageSource
+}
+
+// NewSubCropSource wraps src so that it can also get the sub-crops of its images
+func NewSubCropSource(src ImageSource) ImageSource {
+	return &subCropSource{src}
+}
+
+func (s *subCropSource) GetImageNames() ([]string, error) {
+	return s.src.GetImageNames()
+}
+
+func (s *subCropSource) GetImage(name string) (image.Image, error) {
+	base, crop, ok := SplitSubCrop(name)
+	img, err := s.src.GetImage(base)
+	if err != nil || !ok {
+		return img, err
+	}
+	return crop.Apply(img), nil
+}
+
+func (s *subCropSource) GetImageInfo(name string) (ImageInfo, error) {
+	return s.src.GetImageInfo(BaseName(name))
+}
+
+func (s *subCropSource) Close() {
+	s.src.Close()
+}
@@ -0,0 +1,52 @@
+package source
+
+import (
+	"image"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestSubCropName(t *testing.T) {
+	crop := SubCrop{AspectRatio: image.Point{4, 3}, Scale: 70, X: 0, Y: 100}
+	name := crop.Name("dir/photo#1.jpg")
+	base, parsed, ok := SplitSubCrop(name)
+	if !ok || base != "dir/photo#1.jpg" || parsed != crop {
+		t.Fatalf("Got %s %v %v from %s", base, parsed, ok, name)
+	}
+	if BaseName("dir/photo.jpg") != "dir/photo.jpg" {
+		t.Fatalf("Names without a sub-crop should be their own base name")
+	}
+	if _, _, ok := SplitSubCrop("photo.jpg#crop=big"); ok {
+		t.Fatalf("Malformed sub-crops should not parse")
+	}
+}
+
+func TestSubCropApply(t *testing.T) {
+	img := imaging.New(500, 300, image.Black)
+	crops := SubCropGrid(image.Point{4, 3}, 3, 50)
+	if len(crops) != 9 {
+		t.Fatalf("Got %d crops, expected 9", len(crops))
+	}
+	// The largest 4:3 crop is 400x300 starting at x=50, mark the corners of the top left, center
+	// and bottom right crops
+	expected := map[int]image.Rectangle{
+		0: image.Rect(50, 0, 250, 150),
+		4: image.Rect(150, 75, 350, 225),
+		8: image.Rect(250, 150, 450, 300),
+	}
+	for _, rect := range expected {
+		img.Set(rect.Min.X, rect.Min.Y, image.White)
+		img.Set(rect.Max.X-1, rect.Max.Y-1, image.White)
+	}
+	for i, rect := range expected {
+		cropped := imaging.Clone(crops[i].Apply(img))
+		size := cropped.Rect.Size()
+		if size != rect.Size() {
+			t.Fatalf("Crop %v has size %v, expected %v", crops[i], size, rect.Size())
+		}
+		if cropped.NRGBAAt(0, 0).R != 0xff || cropped.NRGBAAt(size.X-1, size.Y-1).R != 0xff {
+			t.Fatalf("Crop %v is in the wrong place, expected %v", crops[i], rect)
+		}
+	}
+}
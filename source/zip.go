@@ -49,6 +49,13 @@ func (z *zipImageSource) GetImage(name string) (image.Image, error) {
 	return nil, fmt.Errorf("image not found %s", name)
 }
 
+func (z *zipImageSource) GetImageInfo(name string) (ImageInfo, error) {
+	if f := z.images[name]; f != nil {
+		return ImageInfo{Size: int64(f.UncompressedSize64), ModTime: f.Modified}, nil
+	}
+	return ImageInfo{}, fmt.Errorf("image not found %s", name)
+}
+
 func (z *zipImageSource) Close() {
 	z.reader.Close()
 }
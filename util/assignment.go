@@ -0,0 +1,186 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"container/heap"
+	"math"
+)
+
+// AssignmentEdge is a column that a row can be assigned to, and the cost of doing so
+type AssignmentEdge struct {
+	Column int
+	Cost   float64
+}
+
+// Unassigned is the column of rows that MinCostAssignment could not assign
+const Unassigned = -1
+
+type distanceItem struct {
+	node     int
+	distance float64
+}
+
+type distanceHeap []distanceItem
+
+func (h distanceHeap) Len() int            { return len(h) }
+func (h distanceHeap) Less(i, j int) bool  { return h[i].distance < h[j].distance }
+func (h distanceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *distanceHeap) Push(x interface{}) { *h = append(*h, x.(distanceItem)) }
+func (h *distanceHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// MinCostAssignment assigns each row to the column of one of its edges, with at most capacity rows
+// per column, so that as many rows as possible are assigned at the lowest total cost. Costs must not be
+// negative, and capacity 0 is unlimited. Returns the column of each row, or Unassigned.
+//
+// It is solved as a min-cost flow, adding one row at a time along the shortest augmenting path
+// from it. Each search stops as soon as it finds a column with room, so rows whose best columns
+// are free are assigned without looking at the rest of the problem.
+func MinCostAssignment(rows [][]AssignmentEdge, columns int, capacity int) []int {
+	// Nodes are the rows, then the columns, then the sink. Every row also has an edge straight to
+	// the sink that costs more than any path through the columns, for rows that can't be assigned.
+	maxCost := 0.0
+	for _, edges := range rows {
+		for _, e := range edges {
+			maxCost = math.Max(maxCost, e.Cost)
+		}
+	}
+	unassignedCost := (maxCost + 1) * float64(2*len(rows)+1)
+	sink := len(rows) + columns
+
+	assigned := make([]int, len(rows))
+	assignedCost := make([]float64, len(rows))
+	for i := range assigned {
+		assigned[i] = Unassigned
+	}
+	// Rows assigned to each column, in a slice rather than a map so that ties are always broken the same way
+	columnRows := make([][]int, columns)
+	unassign := func(row int) {
+		rows := columnRows[assigned[row]]
+		for i, r := range rows {
+			if r == row {
+				columnRows[assigned[row]] = append(rows[:i], rows[i+1:]...)
+				break
+			}
+		}
+		assigned[row] = Unassigned
+	}
+	hasRoom := func(column int) bool {
+		return capacity == 0 || len(columnRows[column]) < capacity
+	}
+
+	// Node potentials keep the reduced costs non-negative for Dijkstra. Nodes that a search doesn't
+	// reach all move by the same amount, which is kept in shift instead of updating each of them.
+	potentials := make([]float64, sink+1)
+	shift := 0.0
+	potential := func(node int) float64 {
+		return potentials[node] + shift
+	}
+
+	// Search state, only valid for nodes the current search has reached
+	distances := make([]float64, sink+1)
+	previous := make([]int, sink+1)
+	reached := make([]int, sink+1)
+	done := make([]bool, sink+1)
+	touched := make([]int, 0)
+	for row := range rows {
+		search := row + 1
+		touched = touched[:0]
+		h := distanceHeap{{node: row}}
+		reach := func(node int, d float64) {
+			if reached[node] != search {
+				reached[node] = search
+				done[node] = false
+				touched = append(touched, node)
+			}
+			distances[node] = d
+		}
+		reach(row, 0)
+		relax := func(from, to int, cost float64) {
+			d := distances[from] + cost + potential(from) - potential(to)
+			if reached[to] != search || d < distances[to] {
+				reach(to, d)
+				previous[to] = from
+				heap.Push(&h, distanceItem{node: to, distance: d})
+			}
+		}
+		for h.Len() > 0 {
+			item := heap.Pop(&h).(distanceItem)
+			node := item.node
+			if done[node] || item.distance > distances[node] {
+				continue
+			}
+			done[node] = true
+			if node == sink {
+				break
+			}
+			if node < len(rows) {
+				for _, e := range rows[node] {
+					if assigned[node] != e.Column {
+						relax(node, len(rows)+e.Column, e.Cost)
+					}
+				}
+				if assigned[node] != Unassigned || node == row {
+					relax(node, sink, unassignedCost)
+				}
+			} else {
+				column := node - len(rows)
+				for _, r := range columnRows[column] {
+					relax(node, r, -assignedCost[r])
+				}
+				if hasRoom(column) {
+					relax(node, sink, 0)
+				}
+			}
+		}
+
+		// Update the potentials, with the unreached nodes moving by the distance to the sink
+		sinkDistance := distances[sink]
+		for _, node := range touched {
+			if done[node] {
+				potentials[node] += distances[node] - sinkDistance
+			}
+		}
+		shift += sinkDistance
+
+		// Walk the path back from the sink, moving each row on it to the next column
+		for node := sink; node != row; {
+			from := previous[node]
+			if from < len(rows) {
+				if assigned[from] != Unassigned {
+					unassign(from)
+				}
+				if node != sink {
+					column := node - len(rows)
+					assignedCost[from] = math.Inf(1)
+					for _, e := range rows[from] {
+						if e.Column == column {
+							assignedCost[from] = math.Min(assignedCost[from], e.Cost)
+						}
+					}
+					assigned[from] = column
+					columnRows[column] = append(columnRows[column], from)
+				}
+			}
+			node = from
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// bruteForceAssignment tries every assignment, preferring more assigned rows and then lower cost
+func bruteForceAssignment(rows [][]AssignmentEdge, columns, capacity int) (int, float64) {
+	bestAssigned, bestCost := -1, math.Inf(1)
+	used := make([]int, columns)
+	var try func(row, assigned int, cost float64)
+	try = func(row, assigned int, cost float64) {
+		if row == len(rows) {
+			if assigned > bestAssigned || (assigned == bestAssigned && cost < bestCost) {
+				bestAssigned, bestCost = assigned, cost
+			}
+			return
+		}
+		try(row+1, assigned, cost)
+		for _, e := range rows[row] {
+			if capacity == 0 || used[e.Column] < capacity {
+				used[e.Column]++
+				try(row+1, assigned+1, cost+e.Cost)
+				used[e.Column]--
+			}
+		}
+	}
+	try(0, 0, 0)
+	return bestAssigned, bestCost
+}
+
+func TestMinCostAssignment(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for iteration := 0; iteration < 200; iteration++ {
+		columns := 1 + r.Intn(5)
+		rows := make([][]AssignmentEdge, 1+r.Intn(6))
+		for i := range rows {
+			for _, column := range r.Perm(columns)[:1+r.Intn(columns)] {
+				rows[i] = append(rows[i], AssignmentEdge{Column: column, Cost: r.Float64()})
+			}
+		}
+		capacity := r.Intn(3)
+
+		result := MinCostAssignment(rows, columns, capacity)
+		assigned, cost := 0, 0.0
+		used := make([]int, columns)
+		for i, column := range result {
+			if column == Unassigned {
+				continue
+			}
+			found := false
+			for _, e := range rows[i] {
+				if e.Column == column {
+					found = true
+					cost += e.Cost
+				}
+			}
+			if !found {
+				t.Fatalf("Row %d assigned to column %d, which it has no edge to", i, column)
+			}
+			assigned++
+			used[column]++
+			if capacity > 0 && used[column] > capacity {
+				t.Fatalf("Column %d used %d times, capacity is %d", column, used[column], capacity)
+			}
+		}
+		expectedAssigned, expectedCost := bruteForceAssignment(rows, columns, capacity)
+		if assigned != expectedAssigned || math.Abs(cost-expectedCost) > 1e-9 {
+			t.Fatalf("Assigned %d rows for %f, expected %d rows for %f. rows=%v capacity=%d",
+				assigned, cost, expectedAssigned, expectedCost, rows, capacity)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"image"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// labStats is the mean and standard deviation of each of the L*a*b* channels of some pixels
+type labStats struct {
+	mean, deviation [3]float64
+}
+
+// toLab converts the pixels of img to L*a*b*, skipping transparent pixels if skipTransparent is set
+func toLab(img *image.NRGBA, skipTransparent bool) [][3]float64 {
+	size := img.Rect.Size()
+	lab := make([][3]float64, 0, size.X*size.Y)
+	for y := 0; y < size.Y; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+size.X*4]
+		for x := 0; x < len(row); x += 4 {
+			if skipTransparent && row[x+3] < 0x80 {
+				continue
+			}
+			l, a, b := colorful.Color{R: float64(row[x]) / 255.0, G: float64(row[x+1]) / 255.0, B: float64(row[x+2]) / 255.0}.Lab()
+			lab = append(lab, [3]float64{l, a, b})
+		}
+	}
+	return lab
+}
+
+func computeLabStats(lab [][3]float64) labStats {
+	var s labStats
+	for _, p := range lab {
+		for c := range p {
+			s.mean[c] += p[c] / float64(len(lab))
+		}
+	}
+	for _, p := range lab {
+		for c := range p {
+			s.deviation[c] += (p[c] - s.mean[c]) * (p[c] - s.mean[c]) / float64(len(lab))
+		}
+	}
+	for c := range s.deviation {
+		s.deviation[c] = math.Sqrt(s.deviation[c])
+	}
+	return s
+}
+
+// CorrectColor shifts the colors of tile toward those of reference, Reinhard style: the mean
+// L*a*b* color of tile is moved to that of reference, and with matchDeviation the spread of each
+// channel is scaled to match too. No pixel is changed by more than maxCorrection, which is on the
+// go-colorful scale where L* is in [0, 1]. Transparent pixels of reference are ignored, as are
+// the pixels of tile outside of mask if it is not nil.
+func CorrectColor(tile, reference *image.NRGBA, mask *image.Alpha, maxCorrection float64, matchDeviation bool) *image.NRGBA {
+	referenceLab := toLab(reference, true)
+	if len(referenceLab) == 0 || maxCorrection <= 0 {
+		return tile
+	}
+	target := computeLabStats(referenceLab)
+	tileLab := toLab(tile, false)
+	size := tile.Rect.Size()
+	visibleLab := tileLab
+	if mask != nil {
+		visibleLab = make([][3]float64, 0, len(tileLab))
+		for i, p := range tileLab {
+			if mask.AlphaAt(mask.Rect.Min.X+i%size.X, mask.Rect.Min.Y+i/size.X).A >= 0x80 {
+				visibleLab = append(visibleLab, p)
+			}
+		}
+		if len(visibleLab) == 0 {
+			return tile
+		}
+	}
+	current := computeLabStats(visibleLab)
+
+	scale := [3]float64{1, 1, 1}
+	if matchDeviation {
+		for c := range scale {
+			if current.deviation[c] > 0 {
+				scale[c] = target.deviation[c] / current.deviation[c]
+			}
+		}
+	}
+
+	corrected := image.NewNRGBA(image.Rectangle{Max: size})
+	for i, p := range tileLab {
+		var delta [3]float64
+		length := 0.0
+		for c := range p {
+			delta[c] = target.mean[c] + (p[c]-current.mean[c])*scale[c] - p[c]
+			length += delta[c] * delta[c]
+		}
+		length = math.Sqrt(length)
+		limit := 1.0
+		if length > maxCorrection {
+			limit = maxCorrection / length
+		}
+		r, g, b := colorful.Lab(p[0]+delta[0]*limit, p[1]+delta[1]*limit, p[2]+delta[2]*limit).Clamped().RGB255()
+		x, y := i%size.X, i/size.X
+		src := tile.Pix[y*tile.Stride+x*4:]
+		corrected.Pix[i*4], corrected.Pix[i*4+1], corrected.Pix[i*4+2], corrected.Pix[i*4+3] = r, g, b, src[3]
+	}
+	return corrected
+}
+
+// ToneMap renders img in two tones, mapping the L* of each pixel onto the blend of shadow and
+// highlight at that lightness. Black and white shadow and highlight make a grayscale image.
+func ToneMap(img *image.NRGBA, shadow, highlight colorful.Color) *image.NRGBA {
+	// Lightness is quantized finely enough that neighboring levels round to the same 8 bit color
+	const levels = 1024
+	var tones [levels + 1][3]uint8
+	for i := range tones {
+		r, g, b := shadow.BlendLab(highlight, float64(i)/levels).Clamped().RGB255()
+		tones[i] = [3]uint8{r, g, b}
+	}
+
+	size := img.Rect.Size()
+	mapped := image.NewNRGBA(image.Rectangle{Max: size})
+	for y := 0; y < size.Y; y++ {
+		src := img.Pix[y*img.Stride : y*img.Stride+size.X*4]
+		dst := mapped.Pix[y*mapped.Stride : y*mapped.Stride+size.X*4]
+		for x := 0; x < len(src); x += 4 {
+			l, _, _ := colorful.Color{R: float64(src[x]) / 255.0, G: float64(src[x+1]) / 255.0, B: float64(src[x+2]) / 255.0}.Lab()
+			tone := tones[int(math.Round(math.Max(0, math.Min(1, l))*levels))]
+			dst[x], dst[x+1], dst[x+2], dst[x+3] = tone[0], tone[1], tone[2], src[x+3]
+		}
+	}
+	return mapped
+}
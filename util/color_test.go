@@ -0,0 +1,71 @@
+package util
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+func TestCorrectColor(t *testing.T) {
+	tile := imaging.New(4, 4, color.NRGBA{0x80, 0x80, 0x80, 0xff})
+	reference := imaging.New(2, 2, color.NRGBA{0x90, 0x80, 0x80, 0xff})
+	// Transparent pixels of the reference don't count
+	reference.SetNRGBA(0, 0, color.NRGBA{0, 0, 0xff, 0})
+
+	corrected := CorrectColor(tile, reference, nil, 1, false)
+	if c := corrected.NRGBAAt(3, 3); c != (color.NRGBA{0x90, 0x80, 0x80, 0xff}) {
+		t.Fatalf("Wrong corrected color, got %v, expected the reference color", c)
+	}
+
+	// A small maxCorrection only moves part of the way
+	corrected = CorrectColor(tile, reference, nil, 0.01, true)
+	if c := corrected.NRGBAAt(3, 3); c.R <= 0x80 || c.R >= 0x90 {
+		t.Fatalf("Wrong corrected color %v, expected red between 0x80 and 0x90", c)
+	}
+}
+
+func TestCorrectColorMask(t *testing.T) {
+	gray := color.NRGBA{0x80, 0x80, 0x80, 0xff}
+	tile := imaging.New(4, 4, gray)
+	mask := image.NewAlpha(tile.Rect)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if x < 2 {
+				mask.SetAlpha(x, y, color.Alpha{0xff})
+			} else {
+				// Corners that are never drawn shouldn't pull the visible pixels toward red
+				tile.SetNRGBA(x, y, color.NRGBA{0xff, 0, 0, 0xff})
+			}
+		}
+	}
+	reference := imaging.New(4, 4, gray)
+
+	corrected := CorrectColor(tile, reference, mask, 1, false)
+	if c := corrected.NRGBAAt(0, 0); c != gray {
+		t.Fatalf("Visible pixels already match the reference, got %v, expected %v", c, gray)
+	}
+	corrected = CorrectColor(tile, reference, nil, 1, false)
+	if c := corrected.NRGBAAt(0, 0); c == gray {
+		t.Fatalf("Without the mask, the red pixels should shift the mean")
+	}
+}
+
+func TestToneMap(t *testing.T) {
+	img := imaging.New(2, 1, color.NRGBA{0xff, 0, 0, 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	gray := ToneMap(img, colorful.Color{}, colorful.Color{R: 1, G: 1, B: 1})
+	if c := gray.NRGBAAt(0, 0); c.R != c.G || c.G != c.B || c.R == 0 || c.R == 0xff {
+		t.Fatalf("Red should map to a gray, got %v", c)
+	}
+	if c := gray.NRGBAAt(1, 0); c != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("White should stay white, got %v", c)
+	}
+
+	sepia := ToneMap(img, colorful.Color{R: 0.2, G: 0.1, B: 0}, colorful.Color{R: 1, G: 0.9, B: 0.8})
+	if c := sepia.NRGBAAt(0, 0); c.R <= c.B {
+		t.Fatalf("Tones should be between the shadow and highlight, got %v", c)
+	}
+}
@@ -17,6 +17,8 @@ package util
 import (
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"math"
 	"strconv"
 	"strings"
@@ -98,6 +100,26 @@ func Paste(dst, src *image.NRGBA, loc image.Point, blend float64) error {
 	return nil
 }
 
+// PasteMasked draws the src image over the dst image at the given location, only where mask is
+// opaque. A nil mask draws all of src. Unlike Paste, src is cut off at the edges of dst.
+func PasteMasked(dst, src *image.NRGBA, mask *image.Alpha, loc image.Point, blend float64) error {
+	if blend <= 0.0 || blend > 1.0 {
+		return fmt.Errorf("blend must be between (0.0, 1.0]")
+	}
+
+	var m image.Image = image.NewUniform(color.Alpha{A: uint8(math.Round(blend * 0xff))})
+	if mask != nil {
+		blended := image.NewAlpha(mask.Rect)
+		for i, a := range mask.Pix {
+			blended.Pix[i] = uint8(math.Round(float64(a) * blend))
+		}
+		m = blended
+	}
+	r := image.Rectangle{Min: loc, Max: loc.Add(src.Rect.Size())}
+	draw.DrawMask(dst, r, src, src.Rect.Min, m, m.Bounds().Min, draw.Over)
+	return nil
+}
+
 // Calculate the minimum number of tiles in each direction to go from the tile aspect ratio to the image aspect ratio
 func MinTiles(imageAspectRatio image.Point, tileAspectRatio image.Point) image.Point {
 	target := image.Point{
@@ -139,6 +161,18 @@ func ParseAspectRatioString(aspectRatio string) (image.Point, error) {
 	return image.Point{x, y}, nil
 }
 
+// LandscapeAspectRatio reduces the aspect ratio to its smallest terms, with X >= Y
+func LandscapeAspectRatio(aspectRatio image.Point) image.Point {
+	divisor := gcd(aspectRatio.X, aspectRatio.Y)
+	if divisor == 0 {
+		return aspectRatio
+	}
+	return image.Point{
+		X: max(aspectRatio.X, aspectRatio.Y) / divisor,
+		Y: min(aspectRatio.X, aspectRatio.Y) / divisor,
+	}
+}
+
 func NearestSaneAspectRatio(aspectRatio image.Point) image.Point {
 	ratio := float64(max(aspectRatio.X, aspectRatio.Y)) / float64(min(aspectRatio.Y, aspectRatio.X))
 	returnRatio := aspectRatio
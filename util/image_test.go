@@ -2,7 +2,10 @@ package util
 
 import (
 	"image"
+	"image/color"
 	"testing"
+
+	"github.com/disintegration/imaging"
 )
 
 func TestMinTiles(t *testing.T) {
@@ -40,3 +43,26 @@ func TestConvertTiles(t *testing.T) {
 		t.Fatalf("Wrong number of tiles actual=%v, expected=%v", actual, expected)
 	}
 }
+
+func TestPasteMasked(t *testing.T) {
+	dst := imaging.New(4, 4, color.NRGBA{0, 0, 0, 0xff})
+	src := imaging.New(3, 3, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	mask := image.NewAlpha(image.Rect(0, 0, 3, 3))
+	mask.SetAlpha(0, 0, color.Alpha{0xff})
+	mask.SetAlpha(2, 2, color.Alpha{0xff})
+	// The top left corner of src is off the edge of dst, so only the bottom right of the mask is drawn
+	if err := PasteMasked(dst, src, mask, image.Point{-1, -1}, 1.0); err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			expected := uint8(0)
+			if x == 1 && y == 1 {
+				expected = 0xff
+			}
+			if c := dst.NRGBAAt(x, y); c.R != expected {
+				t.Fatalf("Wrong color at (%d,%d), got %v, expected red %d", x, y, c, expected)
+			}
+		}
+	}
+}